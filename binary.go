@@ -0,0 +1,650 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+)
+
+// The binary format is a header, a payload and a checksum. The header is
+// binaryMagic, the format version and a byte which is binaryTemplate or
+// binarySet. The checksum is the big endian CRC-32 (IEEE) of the header and the
+// payload.
+const (
+	binaryMagic    = "stem"
+	binaryVersion  = 2
+	binaryTemplate = 't'
+	binarySet      = 's'
+)
+
+// binaryDepthLimit stops pathological nesting of nodes and expressions.
+const binaryDepthLimit = 1000
+
+// Node types in the binary format.
+const (
+	binArray byte = iota + 1
+	binBlock
+	binEach
+	binExtends
+	binIf
+	binIfdef
+	binIfndef
+	binInclude
+	binObject
+	binPrint
+	binString
+)
+
+// Expression and literal types in the binary format.
+const (
+	binNil byte = iota
+	binBinary
+	binLit
+	binNot
+	binPath
+	binStr
+	binInt
+	binFloat
+	binBool
+)
+
+// MarshalBinary encodes the parsed template, the templates defined inside it
+// and its options. Formatters aren't encoded, call Funcs after decoding.
+func (tmpl *Template) MarshalBinary() ([]byte, error) {
+	e := newEncoder(binaryTemplate)
+	e.template(tmpl)
+	return e.finish(), nil
+}
+
+// UnmarshalBinary decodes a template encoded by MarshalBinary. An error is
+// returned if the data is corrupt or was encoded by an incompatible version.
+func (tmpl *Template) UnmarshalBinary(data []byte) error {
+	d, err := newDecoder(data, binaryTemplate)
+	if err != nil {
+		return err
+	}
+	t := d.template()
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*tmpl = *t
+	return nil
+}
+
+// MarshalBinary encodes the templates and options of the set in to a bundle
+// which can be loaded with UnmarshalBinary, for example to parse templates at
+// build time. Formatters aren't encoded.
+func (s *Set) MarshalBinary() ([]byte, error) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	var names []string
+	for name := range s.cache {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e := newEncoder(binarySet)
+	e.options(&s.opts)
+	e.uint(uint64(len(names)))
+	for _, name := range names {
+		// Defines are in the set so they don't need to be encoded twice.
+		t := *s.cache[name]
+		t.defines = nil
+		e.template(&t)
+	}
+	return e.finish(), nil
+}
+
+// UnmarshalBinary replaces the templates and options of the set with the ones
+// in a bundle encoded by MarshalBinary. Formatters added with Funcs are kept.
+// An include cycle is an error like Set.Add. The set isn't changed if an error
+// is returned.
+func (s *Set) UnmarshalBinary(data []byte) error {
+	d, err := newDecoder(data, binarySet)
+	if err != nil {
+		return err
+	}
+	var opts ExecuteOptions
+	d.options(&opts)
+	tmpls := make([]*Template, d.len())
+	for i := range tmpls {
+		tmpls[i] = d.template()
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	cache := make(map[string]*Template, len(tmpls))
+	for _, t := range tmpls {
+		if _, ok := cache[t.name]; ok {
+			return fmt.Errorf("%v, duplicate template %q", errCorrupt, t.name)
+		}
+		cache[t.name] = t
+	}
+	// The cycle check of Set.Add isn't skipped so executing can't recurse
+	// forever.
+	decoded := &Set{cache: cache}
+	for _, t := range tmpls {
+		if err := decoded.cycle(t); err != nil {
+			return err
+		}
+	}
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.cache = cache
+	s.opts = opts
+	return nil
+}
+
+// encoder writes the binary format.
+type encoder struct {
+	buf bytes.Buffer
+}
+
+// newEncoder returns an encoder which has written the header.
+func newEncoder(kind byte) *encoder {
+	e := &encoder{}
+	e.buf.WriteString(binaryMagic)
+	e.uint(binaryVersion)
+	e.buf.WriteByte(kind)
+	return e
+}
+
+// finish appends the checksum and returns the encoded bytes.
+func (e *encoder) finish() []byte {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(e.buf.Bytes()))
+	e.buf.Write(sum[:])
+	return e.buf.Bytes()
+}
+
+func (e *encoder) uint(u uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutUvarint(b[:], u)])
+}
+
+func (e *encoder) int(i int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutVarint(b[:], i)])
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.uint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) template(t *Template) {
+	e.string(t.name)
+	e.options(&t.opts)
+	e.bool(t.esc != nil)
+	e.nodes(t.tree)
+	e.uint(uint64(len(t.defines)))
+	for _, d := range t.defines {
+		e.template(d)
+	}
+}
+
+func (e *encoder) options(o *ExecuteOptions) {
+	e.int(int64(o.MaxDepth))
+	e.int(int64(o.MissingKey))
+	e.int(o.MaxOutputBytes)
+	e.int(int64(o.MaxNodes))
+	e.int(int64(o.MaxIterations))
+	e.int(int64(o.MaxIncludeDepth))
+}
+
+func (e *encoder) pos(p pos) {
+	e.uint(uint64(p.line))
+	e.uint(uint64(p.col))
+	e.string(p.tag)
+}
+
+// nodes writes a list of nodes. A nil list is distinct from an empty list
+// because a nil else means the section has no else.
+func (e *encoder) nodes(tree []node) {
+	if tree == nil {
+		e.uint(0)
+		return
+	}
+	e.uint(uint64(len(tree)) + 1)
+	for _, n := range tree {
+		e.node(n)
+	}
+}
+
+func (e *encoder) node(n node) {
+	switch nt := n.(type) {
+	case *nodeArray:
+		e.section(binArray, nt.pos, nt.name, nt.nodes, nt.alt)
+	case *nodeBlock:
+		e.buf.WriteByte(binBlock)
+		e.pos(nt.pos)
+		e.string(nt.name)
+		e.nodes(nt.nodes)
+	case *nodeEach:
+		e.section(binEach, nt.pos, nt.name, nt.nodes, nt.alt)
+	case *nodeExtends:
+		e.buf.WriteByte(binExtends)
+		e.pos(nt.pos)
+		e.string(nt.name)
+	case *nodeIf:
+		e.section(binIf, nt.pos, nt.name, nt.nodes, nt.alt)
+		e.expr(nt.expr)
+	case *nodeIfdef:
+		e.section(binIfdef, nt.pos, nt.name, nt.nodes, nt.alt)
+	case *nodeIfndef:
+		e.section(binIfndef, nt.pos, nt.name, nt.nodes, nt.alt)
+	case *nodeInclude:
+		e.buf.WriteByte(binInclude)
+		e.pos(nt.pos)
+		e.string(nt.val)
+		e.string(nt.name)
+		e.expr(nt.scope)
+		e.uint(uint64(len(nt.args)))
+		for _, a := range nt.args {
+			e.string(a.name)
+			e.expr(a.val)
+		}
+	case *nodeObject:
+		e.section(binObject, nt.pos, nt.name, nt.nodes, nt.alt)
+	case *nodePrint:
+		e.buf.WriteByte(binPrint)
+		e.pos(nt.pos)
+		e.string(nt.name)
+		e.uint(uint64(len(nt.pipe)))
+		for _, c := range nt.pipe {
+			e.string(c.name)
+			e.uint(uint64(len(c.args)))
+			for _, a := range c.args {
+				e.value(a)
+			}
+		}
+		e.bool(nt.raw)
+	case *nodeString:
+		e.buf.WriteByte(binString)
+		e.string(nt.val)
+	default:
+		panic(fmt.Sprintf("unknown type %T, programmer error", n))
+	}
+}
+
+func (e *encoder) section(typ byte, p pos, name string, nodes, alt []node) {
+	e.buf.WriteByte(typ)
+	e.pos(p)
+	e.string(name)
+	e.nodes(nodes)
+	e.nodes(alt)
+}
+
+func (e *encoder) expr(x expr) {
+	switch xt := x.(type) {
+	case nil:
+		e.buf.WriteByte(binNil)
+	case *exprBinary:
+		e.buf.WriteByte(binBinary)
+		e.string(xt.op)
+		e.expr(xt.x)
+		e.expr(xt.y)
+	case *exprLit:
+		e.buf.WriteByte(binLit)
+		e.value(xt.val)
+	case *exprNot:
+		e.buf.WriteByte(binNot)
+		e.expr(xt.x)
+	case *exprPath:
+		e.buf.WriteByte(binPath)
+		e.string(xt.name)
+	default:
+		panic(fmt.Sprintf("unknown type %T, programmer error", x))
+	}
+}
+
+// value writes a literal of an expression or a formatter argument.
+func (e *encoder) value(v interface{}) {
+	switch vt := v.(type) {
+	case nil:
+		e.buf.WriteByte(binNil)
+	case string:
+		e.buf.WriteByte(binStr)
+		e.string(vt)
+	case int64:
+		e.buf.WriteByte(binInt)
+		e.int(vt)
+	case float64:
+		e.buf.WriteByte(binFloat)
+		e.uint(math.Float64bits(vt))
+	case bool:
+		e.buf.WriteByte(binBool)
+		e.bool(vt)
+	default:
+		panic(fmt.Sprintf("unknown type %T, programmer error", v))
+	}
+}
+
+// decoder reads the binary format. The first error is kept in err and every
+// read after it returns a zero value.
+type decoder struct {
+	data  []byte
+	err   error
+	depth int // depth is 1 for the nodes at the top of a template.
+}
+
+// errCorrupt starts the error returned when the data doesn't decode.
+const errCorrupt = "corrupt binary template"
+
+// newDecoder checks the header and checksum and returns a decoder positioned
+// at the start of the payload.
+func newDecoder(data []byte, kind byte) (*decoder, error) {
+	if len(data) < len(binaryMagic)+4 || string(data[:len(binaryMagic)]) != binaryMagic {
+		return nil, errors.New("not a binary template")
+	}
+	payload, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(sum) {
+		return nil, fmt.Errorf("%v, checksum mismatch", errCorrupt)
+	}
+	d := &decoder{data: payload[len(binaryMagic):]}
+	if v := d.uint(); d.err == nil && v != binaryVersion {
+		return nil, fmt.Errorf("binary template version %v, want %v", v, binaryVersion)
+	}
+	if k := d.byte(); d.err == nil && k != kind {
+		if kind == binarySet {
+			return nil, errors.New("binary template isn't a set")
+		}
+		return nil, errors.New("binary template is a set")
+	}
+	return d, d.err
+}
+
+// finish returns the first error, or an error if there are unread bytes.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("trailing bytes")
+	}
+	return d.err
+}
+
+func (d *decoder) fail(msg string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%v, %v", errCorrupt, msg)
+	}
+	d.data = nil
+}
+
+// failVarint fails with the error for the result n of binary.Uvarint.
+func (d *decoder) failVarint(n int) {
+	if n == 0 {
+		d.fail("unexpected end")
+	} else {
+		d.fail("malformed varint")
+	}
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) == 0 {
+		d.fail("unexpected end")
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uint() uint64 {
+	u, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.failVarint(n)
+		return 0
+	}
+	d.data = d.data[n:]
+	return u
+}
+
+func (d *decoder) int() int64 {
+	i, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.failVarint(n)
+		return 0
+	}
+	d.data = d.data[n:]
+	return i
+}
+
+// len reads the length of a list. Every element is at least one byte so a
+// length longer than the rest of the data is corrupt.
+func (d *decoder) len() int {
+	u := d.uint()
+	if u > uint64(len(d.data)) {
+		d.fail("length out of range")
+		return 0
+	}
+	return int(u)
+}
+
+func (d *decoder) bool() bool {
+	switch d.byte() {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	d.fail("malformed bool")
+	return false
+}
+
+func (d *decoder) string() string {
+	u := d.uint()
+	if u > uint64(len(d.data)) {
+		d.fail("string out of range")
+		return ""
+	}
+	s := string(d.data[:u])
+	d.data = d.data[u:]
+	return s
+}
+
+// enter returns false if nodes or expressions are nested too deep. Every call
+// must be followed by a call to leave.
+func (d *decoder) enter() bool {
+	d.depth++
+	if d.depth > binaryDepthLimit {
+		d.fail("depth limit")
+		return false
+	}
+	return true
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+func (d *decoder) template() *Template {
+	t := &Template{name: d.string()}
+	d.options(&t.opts)
+	escaped := d.bool()
+	t.tree = d.nodes()
+	if escaped && d.err == nil {
+		// Escapers and the contexts of includes and blocks aren't encoded. The
+		// strings are already filtered so escaping again gives the same ones.
+		if err := autoEscape(t.tree, &htmlContext{}); err != nil {
+			d.fail("template can't be escaped")
+		}
+		t.esc = &contexts{}
+	}
+	if n := d.len(); n > 0 {
+		t.defines = make([]*Template, n)
+		for i := range t.defines {
+			t.defines[i] = d.template()
+		}
+	}
+	return t
+}
+
+func (d *decoder) options(o *ExecuteOptions) {
+	o.MaxDepth = int(d.int())
+	o.MissingKey = MissingKey(d.int())
+	o.MaxOutputBytes = d.int()
+	o.MaxNodes = int(d.int())
+	o.MaxIterations = int(d.int())
+	o.MaxIncludeDepth = int(d.int())
+}
+
+func (d *decoder) pos() pos {
+	return pos{line: int(d.uint()), col: int(d.uint()), tag: d.string()}
+}
+
+func (d *decoder) nodes() []node {
+	u := d.uint()
+	if u == 0 {
+		return nil
+	}
+	if u-1 > uint64(len(d.data)) {
+		d.fail("length out of range")
+		return nil
+	}
+	if !d.enter() {
+		return nil
+	}
+	defer d.leave()
+	tree := make([]node, 0, u-1)
+	for i := uint64(0); i < u-1 && d.err == nil; i++ {
+		tree = append(tree, d.node())
+	}
+	return tree
+}
+
+func (d *decoder) node() node {
+	switch typ := d.byte(); typ {
+	case binArray:
+		n := &nodeArray{pos: d.pos(), name: d.string()}
+		n.nodes, n.alt = d.nodes(), d.nodes()
+		return n
+	case binBlock:
+		return &nodeBlock{pos: d.pos(), name: d.string(), nodes: d.nodes()}
+	case binEach:
+		n := &nodeEach{pos: d.pos(), name: d.string()}
+		n.nodes, n.alt = d.nodes(), d.nodes()
+		return n
+	case binExtends:
+		if d.depth != 1 {
+			d.fail("extends inside of scope")
+		}
+		return &nodeExtends{pos: d.pos(), name: d.string()}
+	case binIf:
+		n := &nodeIf{pos: d.pos(), name: d.string()}
+		n.nodes, n.alt = d.nodes(), d.nodes()
+		if n.expr = d.expr(); n.expr == nil {
+			d.fail("if without expression")
+		}
+		return n
+	case binIfdef:
+		n := &nodeIfdef{pos: d.pos(), name: d.string()}
+		n.nodes, n.alt = d.nodes(), d.nodes()
+		return n
+	case binIfndef:
+		n := &nodeIfndef{pos: d.pos(), name: d.string()}
+		n.nodes, n.alt = d.nodes(), d.nodes()
+		return n
+	case binInclude:
+		n := &nodeInclude{pos: d.pos(), val: d.string(), name: d.string(), scope: d.expr()}
+		if l := d.len(); l > 0 {
+			n.args = make([]*arg, l)
+			for i := range n.args {
+				a := &arg{name: d.string(), val: d.expr()}
+				if a.val == nil {
+					d.fail("argument without value")
+				}
+				n.args[i] = a
+			}
+		}
+		return n
+	case binObject:
+		n := &nodeObject{pos: d.pos(), name: d.string()}
+		n.nodes, n.alt = d.nodes(), d.nodes()
+		return n
+	case binPrint:
+		n := &nodePrint{pos: d.pos(), name: d.string()}
+		if l := d.len(); l > 0 {
+			n.pipe = make([]*call, l)
+			for i := range n.pipe {
+				c := &call{name: d.string(), args: make([]interface{}, d.len())}
+				for j := range c.args {
+					c.args[j] = d.value()
+				}
+				n.pipe[i] = c
+			}
+		}
+		n.raw = d.bool()
+		return n
+	case binString:
+		return &nodeString{val: d.string()}
+	default:
+		d.fail(fmt.Sprintf("unknown node type %v", typ))
+		return &nodeString{}
+	}
+}
+
+func (d *decoder) expr() expr {
+	if !d.enter() {
+		return nil
+	}
+	defer d.leave()
+	switch typ := d.byte(); typ {
+	case binNil:
+		return nil
+	case binBinary:
+		x := &exprBinary{op: d.string(), x: d.expr(), y: d.expr()}
+		switch x.op {
+		case "&&", "||", "==", "!=", "<", "<=", ">", ">=":
+		default:
+			d.fail(fmt.Sprintf("unknown operator %q", x.op))
+		}
+		if x.x == nil || x.y == nil {
+			d.fail("binary operator without operand")
+		}
+		return x
+	case binLit:
+		return &exprLit{val: d.value()}
+	case binNot:
+		x := &exprNot{x: d.expr()}
+		if x.x == nil {
+			d.fail("not without operand")
+		}
+		return x
+	case binPath:
+		return &exprPath{name: d.string()}
+	default:
+		d.fail(fmt.Sprintf("unknown expression type %v", typ))
+		return nil
+	}
+}
+
+func (d *decoder) value() interface{} {
+	switch typ := d.byte(); typ {
+	case binNil:
+		return nil
+	case binStr:
+		return d.string()
+	case binInt:
+		return d.int()
+	case binFloat:
+		return math.Float64frombits(d.uint())
+	case binBool:
+		return d.bool()
+	default:
+		d.fail(fmt.Sprintf("unknown literal type %v", typ))
+		return nil
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTemplateBinary(t *testing.T) {
+	tests := []string{
+		"",
+		"a\n  \n{{*a|upper|default \"x\" 1 2.5 true}}{{&b}}",
+		"{{#a}}{{*@index}}{{:else}}none{{/a}}{{#b}}{{:else}}{{/b}}{{#c}}x{{/c}}",
+		"{{@a}}{{*@key}}{{/a}}{{$b}}{{*c}}{{/b}}{{+d}}{{/d}}{{-e}}{{/e}}",
+		"{{?a > 1 && !(b == \"x\" || c != nil)}}y{{:else}}n{{/?}}",
+		"{{>card user.a size=\"small\" n=1 ok=false}}{{>b}}",
+		"{{%extends base}}{{%block content}}x{{/content}}",
+		"{{%define item}}<li>{{*name}}</li>{{/item}}{{>item}}",
+		"<a href=\"{{*url}}\" onclick=\"f('{{*a}}')\">{{*b}}</a><style>{{*c}}</style>",
+	}
+	for _, test := range tests {
+		want := MustParse(test)
+		want.SetName("x")
+		want.Filter(NoBlankLines | TrimLeftSpace)
+		if err := want.AutoEscape(); err != nil {
+			t.Fatalf("test %q, couldn't escape: %v", test, err)
+		}
+		want.SetOptions(ExecuteOptions{MissingKey: MissingKeep, MaxNodes: 10})
+		b, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatalf("test %q, couldn't marshal: %v", test, err)
+		}
+		got := &Template{}
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatalf("test %q, couldn't unmarshal: %v", test, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("test %q, got %#v, want %#v", test, got, want)
+		}
+	}
+}
+
+func TestTemplateBinaryErrors(t *testing.T) {
+	b, err := MustParse("{{#a}}{{*b|upper}}{{/a}}").MarshalBinary()
+	if err != nil {
+		t.Fatalf("couldn't marshal: %v", err)
+	}
+	set, err := NewSet().MarshalBinary()
+	if err != nil {
+		t.Fatalf("couldn't marshal set: %v", err)
+	}
+	corrupt := append([]byte{}, b...)
+	corrupt[len(corrupt)/2] ^= 1
+	version := append([]byte{}, b...)
+	version[4] = 3
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{nil, "not a binary template"},
+		{[]byte("{{*a}}"), "not a binary template"},
+		{b[:len(b)-1], "corrupt binary template, checksum mismatch"},
+		{corrupt, "corrupt binary template, checksum mismatch"},
+		{withChecksum(version[:len(version)-4]), "binary template version 3, want 2"},
+		{set, "binary template is a set"},
+		{withChecksum(append(b[:len(b)-4:len(b)-4], 0)), "corrupt binary template, trailing bytes"},
+		{withChecksum(b[:len(b)-5]), "corrupt binary template, unexpected end"},
+	}
+	for _, test := range tests {
+		err := (&Template{}).UnmarshalBinary(test.data)
+		if err == nil || err.Error() != test.want {
+			t.Fatalf("test %q, got %v, want %q", test.data, err, test.want)
+		}
+	}
+	for i := len(binaryMagic); i < len(b)-4; i++ {
+		if err := (&Template{}).UnmarshalBinary(withChecksum(b[:i])); err == nil {
+			t.Fatalf("test %q, expected error for truncated data", b[:i])
+		}
+	}
+}
+
+func TestBinaryIncludeArgWithoutValue(t *testing.T) {
+	tmpl := MustParse("{{>card size=1}}")
+	tmpl.tree[0].(*nodeInclude).args[0].val = nil
+	b, err := tmpl.MarshalBinary()
+	if err != nil {
+		t.Fatalf("couldn't marshal: %v", err)
+	}
+	err = (&Template{}).UnmarshalBinary(b)
+	if want := "corrupt binary template, argument without value"; err == nil || err.Error() != want {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestBinaryExtendsInScope(t *testing.T) {
+	tmpl := MustParse("{{#a}}{{/a}}")
+	tmpl.tree[0].(*nodeArray).nodes = []node{&nodeExtends{name: "b"}}
+	b, err := tmpl.MarshalBinary()
+	if err != nil {
+		t.Fatalf("couldn't marshal: %v", err)
+	}
+	err = (&Template{}).UnmarshalBinary(b)
+	if want := "corrupt binary template, extends inside of scope"; err == nil || err.Error() != want {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}
+
+func TestSetBinaryCycle(t *testing.T) {
+	set := NewSet()
+	// The templates are added without the cycle check of Set.Add.
+	for name, src := range map[string]string{"a": "{{>b}}", "b": "{{>a}}"} {
+		tmpl := MustParse(src)
+		tmpl.SetName(name)
+		set.cache[name] = tmpl
+	}
+	b, err := set.MarshalBinary()
+	if err != nil {
+		t.Fatalf("couldn't marshal: %v", err)
+	}
+	got := NewSet()
+	var e *Error
+	if err := got.UnmarshalBinary(b); !errors.As(err, &e) || e.Kind != ErrCycle {
+		t.Fatalf("got error %v, want cycle", err)
+	}
+	if len(got.cache) != 0 {
+		t.Fatal("set changed by bundle with a cycle")
+	}
+}
+
+// withChecksum appends the checksum of b to b.
+func withChecksum(b []byte) []byte {
+	e := &encoder{}
+	e.buf.Write(b)
+	return e.finish()
+}
+
+func TestSetBinary(t *testing.T) {
+	set := NewSet()
+	set.SetOptions(ExecuteOptions{MissingKey: MissingError})
+	if err := addTemplate(t, set, "base", "<h1>{{%block title}}Home{{/title}}</h1>{{%block content}}{{/content}}"); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	if err := addTemplate(t, set, "page", "{{%extends base}}{{%block content}}{{#items}}{{>item}}{{/items}}{{/content}}{{%define item}}<li>{{*name|upper}}</li>{{/item}}"); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	b, err := set.MarshalBinary()
+	if err != nil {
+		t.Fatalf("couldn't marshal: %v", err)
+	}
+	got := NewSet()
+	if err := addTemplate(t, got, "old", "x"); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatalf("couldn't unmarshal: %v", err)
+	}
+	if got.template("old") != nil {
+		t.Fatal("template not replaced")
+	}
+	if got.opts != set.opts {
+		t.Fatalf("got options %+v, want %+v", got.opts, set.opts)
+	}
+	JSON := `{"items": [{"name": "a"}, {"name": "b"}]}`
+	var want, out bytes.Buffer
+	if err := set.ExecuteJSON(&want, "page", JSON); err != nil {
+		t.Fatalf("couldn't execute: %v", err)
+	}
+	if err := got.ExecuteJSON(&out, "page", JSON); err != nil {
+		t.Fatalf("couldn't execute: %v", err)
+	}
+	if out.String() != want.String() {
+		t.Fatalf("got %q, want %q", out.String(), want.String())
+	}
+	if err := got.ExecuteJSON(&out, "page", `{"items": [{}]}`); err == nil || !strings.Contains(err.Error(), "not defined") {
+		t.Fatalf("got error %v, want missing error", err)
+	}
+	if err := got.UnmarshalBinary(b[:len(b)-1]); err == nil {
+		t.Fatal("expected error for corrupt bundle")
+	}
+	if got.template("page") == nil {
+		t.Fatal("set changed by corrupt bundle")
+	}
+	tmpl, err := MustParse("x").MarshalBinary()
+	if err != nil {
+		t.Fatalf("couldn't marshal: %v", err)
+	}
+	if err := got.UnmarshalBinary(tmpl); err == nil || err.Error() != "binary template isn't a set" {
+		t.Fatalf("got error %v, want not a set", err)
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	src := strings.Repeat("<li>{{#items}}{{*name|upper}}{{?price > 2}} dear{{/?}}{{/items}}</li>\n", 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	src := strings.Repeat("<li>{{#items}}{{*name|upper}}{{?price > 2}} dear{{/?}}{{/items}}</li>\n", 100)
+	data, err := MustParse(src).MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := (&Template{}).UnmarshalBinary(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/sbunce/stem"
+)
+
+// format rewrites templates in the canonical format.
+func format(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fl := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	fl.SetOutput(stderr)
+	list := fl.Bool("l", false, "list files whose formatting differs")
+	write := fl.Bool("w", false, "write the result to the file instead of stdout")
+	fl.Usage = func() {
+		fmt.Fprintf(stderr, "usage: stem fmt [flags] [file ...]\n")
+		fl.PrintDefaults()
+	}
+	if err := fl.Parse(args); err != nil {
+		return 2
+	}
+	if fl.NArg() == 0 {
+		if *write {
+			fmt.Fprintf(stderr, "stem fmt: can't use -w with stdin\n")
+			return 2
+		}
+		src, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "stem fmt: %v\n", err)
+			return 1
+		}
+		if err := formatFile("stdin", src, *list, false, stdout); err != nil {
+			fmt.Fprintf(stderr, "stem fmt: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	code := 0
+	for _, filename := range fl.Args() {
+		src, err := ioutil.ReadFile(filename)
+		if err == nil {
+			err = formatFile(filename, src, *list, *write, stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "stem fmt: %v\n", err)
+			code = 1
+		}
+	}
+	return code
+}
+
+// formatFile formats src. The file name is written to w if list is true and
+// the formatting differs. The file is rewritten if write is true. If neither
+// is true the formatted source is written to w.
+func formatFile(filename string, src []byte, list, write bool, w io.Writer) error {
+	out, err := stem.Format(src)
+	if err != nil {
+		var e *stem.Error
+		if errors.As(err, &e) {
+			e.Name = filename
+		}
+		return err
+	}
+	changed := !bytes.Equal(src, out)
+	if list && changed {
+		fmt.Fprintln(w, filename)
+	}
+	if write && changed {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filename, out, fi.Mode().Perm())
+	}
+	if !list && !write {
+		_, err = w.Write(out)
+	}
+	return err
+}
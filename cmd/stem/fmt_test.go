@@ -0,0 +1,68 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFmt(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.tmpl":   "{{#items}}{{* name | upper }}{{/items}}\n",
+		"b.tmpl":   "{{*a}}\n",
+		"bad.tmpl": "{{#a}}",
+	})
+	a, b, bad := filepath.Join(dir, "a.tmpl"), filepath.Join(dir, "b.tmpl"), filepath.Join(dir, "bad.tmpl")
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"fmt"}, strings.NewReader("{{? a>1 }}x{{/?}}"), &stdout, &stderr); code != 0 {
+		t.Fatalf("got code %v, want 0, stderr %q", code, stderr.String())
+	}
+	if got, want := stdout.String(), "{{?a > 1}}x{{/?}}"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	stdout.Reset()
+	if code := run([]string{"fmt", "-l", a, b}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("got code %v, want 0, stderr %q", code, stderr.String())
+	}
+	if got, want := stdout.String(), a+"\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	stdout.Reset()
+	if code := run([]string{"fmt", "-w", a, b}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("got code %v, want 0, stderr %q", code, stderr.String())
+	}
+	if stdout.Len() != 0 {
+		t.Fatalf("got output %q, want none", stdout.String())
+	}
+	got, err := ioutil.ReadFile(a)
+	if err != nil {
+		t.Fatalf("couldn't read file: %v", err)
+	}
+	if want := "{{#items}}{{*name|upper}}{{/items}}\n"; string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	stdout.Reset()
+	if code := run([]string{"fmt", bad, b}, nil, &stdout, &stderr); code != 1 {
+		t.Fatalf("got code %v, want 1", code)
+	}
+	if got, want := stderr.String(), "stem fmt: "+bad+":1:1: unclosed scope: {{#a}}\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got, want := stdout.String(), "{{*a}}\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	stderr.Reset()
+	if code := run([]string{"fmt", "-w"}, nil, &stdout, &stderr); code != 2 {
+		t.Fatalf("got code %v, want 2", code)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sbunce/stem"
+)
+
+// problem is a lint error in the JSON output.
+type problem struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Col     int    `json:"col,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+	Message string `json:"message"`
+	Tag     string `json:"tag,omitempty"`
+}
+
+// lint reports the problems in a directory of templates.
+func lint(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var partials repeated
+	fl := flag.NewFlagSet("lint", flag.ContinueOnError)
+	fl.SetOutput(stderr)
+	jsonOut := fl.Bool("json", false, "write the problems as a JSON array")
+	data := fl.String("data", "", "check symbols against the sample JSON data in `file`")
+	schema := fl.String("schema", "", "check symbols against the JSON Schema in `file`")
+	fl.Var(&partials, "partials", "report templates matching `pattern` that aren't included, can be repeated")
+	fl.Usage = func() {
+		fmt.Fprintf(stderr, "usage: stem lint [flags] dir [pattern ...]\n")
+		fl.PrintDefaults()
+	}
+	if err := fl.Parse(args); err != nil {
+		return 2
+	}
+	if fl.NArg() < 1 {
+		fl.Usage()
+		return 2
+	}
+	opts := stem.LintOptions{Partials: partials}
+	for _, f := range []struct {
+		name string
+		v    *interface{}
+	}{{*data, &opts.Data}, {*schema, &opts.Schema}} {
+		if f.name == "" {
+			continue
+		}
+		v, err := readData(f.name, stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "stem lint: %v\n", err)
+			return 2
+		}
+		*f.v = v
+	}
+	errs := stem.Lint(os.DirFS(fl.Arg(0)), fl.Args()[1:], opts)
+	if *jsonOut {
+		problems := make([]problem, 0, len(errs))
+		for _, err := range errs {
+			var e *stem.Error
+			if errors.As(err, &e) {
+				problems = append(problems, problem{File: e.Name, Line: e.Line, Col: e.Col, Kind: e.Kind.String(), Message: e.Err.Error(), Tag: e.Tag})
+			} else {
+				problems = append(problems, problem{Message: err.Error()})
+			}
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(problems)
+	} else {
+		for _, err := range errs {
+			fmt.Fprintln(stdout, err)
+		}
+	}
+	if errs != nil {
+		return 1
+	}
+	return 0
+}
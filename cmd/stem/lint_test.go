@@ -0,0 +1,74 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"tmpl/page.tmpl":     "{{>card}}{{>nope}}\n{{*titel}}",
+		"tmpl/card.tmpl":     "{{#a}}",
+		"tmpl/_old.tmpl":     "x",
+		"tmpl/ok/a.tmpl":     "{{*title}}",
+		"data.json":          `{"title": "x"}`,
+		"bad.json":           `{`,
+		"tmpl/ignored.txt":   "{{#",
+		"tmpl/ok/README.txt": "",
+	})
+	tmpl := filepath.Join(dir, "tmpl")
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"lint", "-json", "-partials", "_*", "-data", filepath.Join(dir, "data.json"), tmpl, "*.tmpl"}, nil, &stdout, &stderr)
+	if code != 1 {
+		t.Fatalf("got code %v, want 1, stderr %q", code, stderr.String())
+	}
+	var got []problem
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		t.Fatalf("couldn't unmarshal %q: %v", stdout.String(), err)
+	}
+	want := []problem{
+		{File: "_old.tmpl", Kind: "unused", Message: `template "_old" is never included`},
+		{File: "card.tmpl", Line: 1, Col: 1, Kind: "unclosed", Message: "unclosed scope", Tag: "{{#a}}"},
+		{File: "card.tmpl", Line: 1, Col: 1, Kind: "missing", Message: `"a" not in sample data`, Tag: "{{#a}}"},
+		{File: "page.tmpl", Line: 1, Col: 10, Kind: "not found", Message: `template "nope" not found`, Tag: "{{>nope}}"},
+		{File: "page.tmpl", Line: 2, Col: 1, Kind: "missing", Message: `"titel" not in sample data`, Tag: "{{*titel}}"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	stdout.Reset()
+	code = run([]string{"lint", tmpl, "page.tmpl", "card.tmpl"}, nil, &stdout, &stderr)
+	if code != 1 {
+		t.Fatalf("got code %v, want 1", code)
+	}
+	if got, want := stdout.String(), "card.tmpl:1:1: unclosed scope: {{#a}}\npage.tmpl:1:10: template \"nope\" not found: {{>nope}}\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	stdout.Reset()
+	if code := run([]string{"lint", "-json", filepath.Join(tmpl, "ok")}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("got code %v, want 0, stdout %q", code, stdout.String())
+	}
+	if got, want := stdout.String(), "[]\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	stderr.Reset()
+	if code := run([]string{"lint", "-data", filepath.Join(dir, "bad.json"), tmpl}, nil, &stdout, &stderr); code != 2 {
+		t.Fatalf("got code %v, want 2", code)
+	}
+	if !strings.Contains(stderr.String(), "bad.json:1:1: unexpected end of JSON input") {
+		t.Fatalf("got %q, want JSON error", stderr.String())
+	}
+	if code := run([]string{"lint"}, nil, &stdout, &stderr); code != 2 {
+		t.Fatalf("got code %v, want 2", code)
+	}
+}
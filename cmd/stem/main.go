@@ -0,0 +1,75 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+// Command stem works with templates from the command line.
+//
+// Usage:
+//
+//	stem render -t page.tmpl [-d data.json] [-I dir] [-filter list] [-o file]
+//	stem lint [-json] [-partials pattern] [-data file] [-schema file] dir [pattern ...]
+//	stem fmt [-l] [-w] [file ...]
+//
+// The render command executes a template with JSON data read from a file, or
+// from stdin if there is no -d flag or it is "-". Templates in the -I
+// directories, which can be repeated, can be included and are named like
+// stem.Set.ParseDir. The -filter flag is a comma separated list of noblank,
+// trimleft and trimright, see stem.Filter.
+//
+// The exit code is 0 on success, 1 if a template or the data couldn't be
+// loaded or executed, and 2 if the command line is invalid. Errors include the
+// template name, line and column.
+//
+// The lint command parses every template in dir that matches a pattern, see
+// stem.Lint, and reports every syntax error, include of a template that
+// doesn't exist, include cycle, partial matching -partials that isn't
+// included, and symbol that isn't in the -data or -schema file. The -json flag
+// writes the problems as a JSON array of objects with file, line, col, kind,
+// message and tag fields. The exit code is 0 if there are no problems, 1 if
+// there are and 2 if the command line or the data is invalid.
+//
+// The fmt command rewrites templates in the canonical format, see stem.Format.
+// Without files it formats stdin. The formatted source is written to stdout
+// unless -l lists the files whose formatting differs or -w rewrites them. The
+// exit code is 1 if a template doesn't parse.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// command is a subcommand. It returns the exit code.
+type command func(args []string, stdin io.Reader, stdout, stderr io.Writer) int
+
+var commands = map[string]command{
+	"fmt":    format,
+	"lint":   lint,
+	"render": render,
+}
+
+const usage = `usage: stem <command> [flags]
+
+commands:
+	fmt     rewrite templates in the canonical format
+	lint    report problems in a directory of templates
+	render  execute a template with JSON data
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command in args and returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "stem: unknown command %q\n%v", args[0], usage)
+		return 2
+	}
+	return cmd(args[1:], stdin, stdout, stderr)
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sbunce/stem"
+)
+
+// filters are the names of the -filter flag values.
+var filters = map[string]stem.Filter{
+	"noblank":   stem.NoBlankLines,
+	"trimleft":  stem.TrimLeftSpace,
+	"trimright": stem.TrimRightSpace,
+}
+
+// repeated is a flag that can be repeated.
+type repeated []string
+
+func (r *repeated) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *repeated) Set(s string) error {
+	*r = append(*r, s)
+	return nil
+}
+
+// filterFlag is a comma separated list of filters.
+type filterFlag stem.Filter
+
+func (f *filterFlag) String() string {
+	var names []string
+	for name, filter := range filters {
+		if stem.Filter(*f)&filter != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (f *filterFlag) Set(list string) error {
+	for _, name := range strings.Split(list, ",") {
+		filter, ok := filters[strings.TrimSpace(name)]
+		if !ok {
+			return fmt.Errorf("unknown filter %q, want noblank, trimleft or trimright", name)
+		}
+		*f |= filterFlag(filter)
+	}
+	return nil
+}
+
+// render executes a template with JSON data.
+func render(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var (
+		includes repeated
+		filter   filterFlag
+	)
+	fl := flag.NewFlagSet("render", flag.ContinueOnError)
+	fl.SetOutput(stderr)
+	tmpl := fl.String("t", "", "execute the template `file`")
+	data := fl.String("d", "-", "read JSON data from `file`, - is stdin")
+	out := fl.String("o", "", "write the output to `file` instead of stdout")
+	autoEscape := fl.Bool("autoescape", false, "escape print tags based on where they appear in HTML")
+	fl.Var(&includes, "I", "load templates to include from `dir`, can be repeated")
+	fl.Var(&filter, "filter", "comma separated `list` of noblank, trimleft and trimright")
+	fl.Usage = func() {
+		fmt.Fprintf(stderr, "usage: stem render -t file [flags]\n")
+		fl.PrintDefaults()
+	}
+	if err := fl.Parse(args); err != nil {
+		return 2
+	}
+	if *tmpl == "" || fl.NArg() > 0 {
+		fl.Usage()
+		return 2
+	}
+	load := func(t *stem.Template) error {
+		t.Filter(stem.Filter(filter))
+		if *autoEscape {
+			return t.AutoEscape()
+		}
+		return nil
+	}
+	var b bytes.Buffer
+	if err := renderFile(&b, *tmpl, *data, includes, stdin, load); err != nil {
+		fmt.Fprintf(stderr, "stem render: %v\n", err)
+		return 1
+	}
+	if *out == "" {
+		if _, err := stdout.Write(b.Bytes()); err != nil {
+			fmt.Fprintf(stderr, "stem render: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if err := ioutil.WriteFile(*out, b.Bytes(), 0644); err != nil {
+		fmt.Fprintf(stderr, "stem render: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// renderFile executes the template file with the data file and writes the
+// output to w. The load func is called on every template before it's added to
+// the set.
+func renderFile(w io.Writer, filename, dataname string, includes []string, stdin io.Reader, load func(*stem.Template) error) error {
+	set := stem.NewSet()
+	set.OnLoad(load)
+	for _, dir := range includes {
+		if err := set.ParseDir(dir); err != nil {
+			return err
+		}
+	}
+	t, err := stem.ParseFile(filename)
+	if err != nil {
+		return err
+	}
+	name := stem.RelName(filepath.Base(filename))
+	t.SetName(name)
+	if err := load(t); err != nil {
+		return err
+	}
+	if err := set.Add(t); err != nil {
+		return err
+	}
+	data, err := readData(dataname, stdin)
+	if err != nil {
+		return err
+	}
+	return set.Execute(w, name, data)
+}
+
+// readData decodes the JSON in the file, or in stdin if the name is "-".
+// Syntax errors include the line and column.
+func readData(name string, stdin io.Reader) (interface{}, error) {
+	var b []byte
+	var err error
+	if name == "-" {
+		name = "stdin"
+		b, err = ioutil.ReadAll(stdin)
+	} else {
+		b, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var data interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		var se *json.SyntaxError
+		if errors.As(err, &se) {
+			line, col := position(b, se.Offset)
+			return nil, fmt.Errorf("%v:%v:%v: %v", name, line, col, err)
+		}
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	return data, nil
+}
+
+// position returns the line and column, starting at 1, of the byte before
+// offset. The json package reports the offset after the byte it couldn't
+// parse.
+func position(b []byte, offset int64) (line, col int) {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	if offset > 0 {
+		offset--
+	}
+	before := b[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	col = len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes the files to a temporary directory and returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, text := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatalf("couldn't create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(text), 0644); err != nil {
+			t.Fatalf("couldn't write file: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestRender(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"page.tmpl":             "{{%extends layouts/base}}{{%block content}}{{>parts/item name=title}}{{/content}}",
+		"inc/layouts/base.tmpl": "<main>\n\n  {{%block content}}{{/content}}\n</main>",
+		"inc/parts/item.tmpl":   "<b>{{*name}}</b>",
+		"data.json":             `{"title": "<x>"}`,
+		"bad.json":              "{\n  \"a\": 1,\n  \"b\" 2\n}",
+		"bad.tmpl":              "a\n{{#a}}",
+		"missing.tmpl":          "{{>nope}}",
+	})
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	tests := []struct {
+		args  []string
+		stdin string
+		code  int
+		want  string
+		err   string
+	}{
+		{
+			args: []string{"render", "-t", path("page.tmpl"), "-d", path("data.json"), "-I", path("inc")},
+			want: "<main>\n\n  <b><x></b>\n</main>",
+		},
+		{
+			args:  []string{"render", "-t", path("page.tmpl"), "-I", path("inc"), "-filter", "noblank,trimleft", "-autoescape"},
+			stdin: `{"title": "<x>"}`,
+			want:  "<main>\n<b>&lt;x&gt;</b>\n</main>",
+		},
+		{
+			args: []string{"render", "-t", path("page.tmpl"), "-d", path("data.json")},
+			code: 1,
+			err:  "stem render: page:1:1: template \"layouts/base\" not found: {{%extends layouts/base}}\n",
+		},
+		{
+			args: []string{"render", "-t", path("page.tmpl"), "-d", path("bad.json"), "-I", path("inc")},
+			code: 1,
+			err:  "bad.json:3:7: invalid character '2' after object key\n",
+		},
+		{
+			args:  []string{"render", "-t", path("bad.tmpl")},
+			stdin: "{}",
+			code:  1,
+			err:   "stem render: bad.tmpl:2:1: unclosed scope: {{#a}}\n",
+		},
+		{
+			args: []string{"render", "-t", path("missing.tmpl"), "-d", path("nope.json")},
+			code: 1,
+			err:  "nope.json: no such file or directory\n",
+		},
+		{
+			args: []string{"render", "-t", path("page.tmpl"), "-filter", "x"},
+			code: 2,
+			err:  "unknown filter \"x\"",
+		},
+		{
+			args: []string{"render"},
+			code: 2,
+			err:  "usage: stem render",
+		},
+		{
+			args: []string{"x"},
+			code: 2,
+			err:  "stem: unknown command \"x\"",
+		},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		code := run(test.args, strings.NewReader(test.stdin), &stdout, &stderr)
+		if code != test.code {
+			t.Fatalf("test %q, got code %v, want %v, stderr %q", test.args, code, test.code, stderr.String())
+		}
+		if stdout.String() != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.args, stdout.String(), test.want)
+		}
+		if !strings.Contains(stderr.String(), test.err) {
+			t.Fatalf("test %q, got error %q, want %q", test.args, stderr.String(), test.err)
+		}
+	}
+}
+
+func TestRenderOutput(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.tmpl": "{{*a}}"})
+	out := filepath.Join(dir, "out.txt")
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"render", "-t", filepath.Join(dir, "a.tmpl"), "-o", out}, strings.NewReader(`{"a": 1.5}`), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("got code %v, stderr %q", code, stderr.String())
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("couldn't read output: %v", err)
+	}
+	if got, want := string(b), "1.5"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if stdout.Len() != 0 {
+		t.Fatalf("got stdout %q, want nothing", stdout.String())
+	}
+}
+
+func TestRenderWriteError(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.tmpl": "{{*a}}"})
+	var stderr bytes.Buffer
+	code := run([]string{"render", "-t", filepath.Join(dir, "a.tmpl")}, strings.NewReader(`{"a": 1}`), failWriter{}, &stderr)
+	if code != 1 {
+		t.Fatalf("got code %v, want 1", code)
+	}
+	if got, want := stderr.String(), "stem render: write failed\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// failWriter returns an error for every write, like a closed pipe.
+type failWriter struct{}
+
+func (failWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
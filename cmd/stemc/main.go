@@ -0,0 +1,71 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+// Command stemc writes Go source which executes the templates in a directory.
+//
+// Usage:
+//
+//	stemc [flags] dir [pattern ...]
+//
+// Templates are named by their path relative to dir without the extension, so
+// "emails/header.tmpl" is generated as the function EmailsHeader. A pattern
+// such as "*.tmpl" is matched against the base name of a file, see
+// stem.Set.ParseFS. Every file is compiled if there are no patterns.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/sbunce/stem"
+)
+
+var (
+	out        = flag.String("o", "", "write the Go source to `file` instead of stdout")
+	pkg        = flag.String("pkg", "templates", "package `name` of the Go source")
+	autoEscape = flag.Bool("autoescape", false, "escape print tags based on where they appear in HTML")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: stemc [flags] dir [pattern ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	src, err := compile(flag.Arg(0), flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *out == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// compile returns the Go source for the templates in dir.
+func compile(dir string, patterns []string) ([]byte, error) {
+	set := stem.NewSet()
+	if *autoEscape {
+		set.OnLoad((*stem.Template).AutoEscape)
+	}
+	if err := set.ParseDir(dir, patterns...); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := set.GenerateGo(&b, *pkg); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
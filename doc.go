@@ -13,9 +13,12 @@ Package stem implements a templating system.
 	Features:
 	-Conditions.
 	-Includes.
+	-Layout inheritance.
+	-Compile to Go source.
 	-Lexical scope.
 	-Repeated sections.
 	-Change delimiter.
+	-Context-aware escaping.
 
 	Design:
 	-Separate tags for "enter object" and "enter array" to be unambiguous.
@@ -25,10 +28,19 @@ Package stem implements a templating system.
 	{{!a}}          Comment.
 	{{#a}}...{{/a}} Enter array.
 	{{$a}}...{{/a}} Enter object.
+	{{@a}}...{{/a}} Enter every value of object in key order.
+	{{?a}}...{{/a}} Render section if expression is true. End with "{{/?}}".
 	{{+a}}...{{/a}} Render section if defined.
 	{{-a}}...{{/a}} Render section if not defined.
+	{{:else}}       Render rest of section if section would not render.
 	{{>a}}          Include template.
+	{{>a b c=d}}    Include template with scope b and argument c.
+	{{%extends a}}  Render template a with the blocks of this template.
+	{{%block a}}...{{/a}} Block a template that extends this one can replace.
+	{{%define a}}...{{/a}} Define template a inside of this template.
 	{{*a}}          Print. To access element of array use "{{*}}".
+	{{&a}}          Print without escaping.
+	{{*a|f x}}      Print after applying formatter f with argument x.
 	{{=<ld> <rd>}}  Change delimiters.
 
 	Print a symbol.
@@ -49,6 +61,35 @@ Package stem implements a templating system.
 	Output:
 		foo
 
+	Else.
+	Any section can have an else. An array section renders the else when the
+	array is empty.
+	JSON:
+		{"a": []}
+	Template:
+		{{#a}}{{*}}{{:else}}foo{{/a}}{{+b}}bar{{:else}}baz{{/b}}
+	Output:
+		foobaz
+
+	Truthiness.
+	False, null, 0, "" and empty arrays and objects are false, like JSON.
+	JSON:
+		{"a": false, "b": [], "c": "foo"}
+	Template:
+		{{?a}}bar{{/a}}{{?b}}bar{{/b}}{{?c}}{{*c}}{{/c}}
+	Output:
+		foo
+
+	Expressions.
+	Conditions support ==, !=, <, <=, >, >=, &&, ||, !, parentheses and
+	string, number, true, false and null literals.
+	JSON:
+		{"status": "active", "count": 2}
+	Template:
+		{{?status == "active" && count > 1}}foo{{:else}}bar{{/?}}
+	Output:
+		foo
+
 	Enter array of documents.
 	JSON:
 	{"a": [{"b": "foo"}, {"b": "bar"}]}
@@ -58,6 +99,15 @@ Package stem implements a templating system.
 	Output:
 		foobar
 
+	Array position.
+	Inside an array @index, @index1, @first, @last and @length are defined.
+	JSON:
+		{"a": ["foo", "bar"]}
+	Template:
+		{{#a}}{{*@index1}}/{{*@length}} {{*}}{{?!@last}}, {{/?}}{{/a}}
+	Output:
+		1/2 foo, 2/2 bar
+
 	Enter array of non-documents.
 	JSON:
 		{"a": ["foo", "bar"]}
@@ -75,6 +125,15 @@ Package stem implements a templating system.
 	Output:
 		foo
 
+	Enter every value of object.
+	Values are entered like array elements. The key is @key.
+	JSON:
+		{"a": {"us": 3, "de": {"b": 5}}}
+	Template:
+		{{@a}}{{*@key}}={{*}}{{*b}} {{/a}}
+	Output:
+		de=5 us=3
+
 	Scoped symbol lookup example 1.
 	JSON:
 		{"a": {"b": "foo"}, "c": "bar"}
@@ -95,6 +154,167 @@ Package stem implements a templating system.
 	Output:
 		foobarbaz
 
+	Paths.
+	Names separated by "." are looked up relative to the previous name. Only
+	the first name is looked up in the enclosing scopes. A name containing "."
+	can be quoted in brackets.
+	JSON:
+		{"a": {"b": {"c": "foo"}, "d.e": "bar"}}
+	Template:
+		{{*a.b.c}}{{*a["d.e"]}}
+	Output:
+		foobar
+
+	Formatters.
+	Formatters are applied left to right. Builtin formatters are date, default,
+	html, js, json, lower, trim, truncate, upper and url. More can be added with
+	Template.Funcs and Set.Funcs.
+	JSON:
+		{"a": " foo ", "b": "2015-03-04T05:06:07Z"}
+	Template:
+		{{*a|trim|upper}}{{*c|default "bar"}}{{*b|date "2006"}}
+	Output:
+		FOObar2015
+
+	Go data.
+	Data can be a map with string keys or a struct. Struct fields are looked up
+	by their json tag, or by field name if they don't have one. A struct in an
+	array, such as a time.Time, is entered and can also be printed by "{{*}}".
+	Go:
+		struct {
+			A string `json:"a"`
+			B []struct{ C int }
+		}{"foo", []struct{ C int }{{1}, {2}}}
+	Template:
+		{{*a}}{{#B}}{{*C}}{{/B}}
+	Output:
+		foo12
+
+	Errors.
+	Parse and execute errors are *Error which has the template name, the line
+	and column of the tag, the tag and the kind of error.
+	Set.Add returns an error if a template would always include itself. An
+	include inside of a section may recurse up to ExecuteOptions.MaxDepth.
+	With ExecuteOptions.MissingKey set to MissingError a print tag, section or
+	include that isn't defined is an error.
+	ExecuteContext returns ctx.Err() if the context is canceled while looping
+	over an array or object or including a template.
+	Template "page.tmpl":
+		{{#a}}{{*b}}{{/c}}
+	Error:
+		page.tmpl:1:13: unmatched tag, expecting end of {{#a}}: {{/c}}
+
+	Include arguments.
+	An include can enter a scope and pass named arguments. Argument values are
+	paths or literals. Names not passed are looked up in the caller, a passed
+	argument is used even if it's undefined.
+	JSON:
+		{"user": {"name": "foo"}}
+	Template "card":
+		{{*name}} {{*size}}
+	Template:
+		{{>card user size="small"}}
+	Output:
+		foo small
+
+	Define.
+	Templates defined inside of a template are added to a Set with it and can
+	be included by name, including recursively.
+	JSON:
+		{"name": "a", "children": [{"name": "b", "children": []}]}
+	Template:
+		{{%define tree}}{{*name}}{{#children}}[{{>tree}}]{{/children}}{{/tree}}{{>tree}}
+	Output:
+		a[b]
+
+	Layouts.
+	A template that extends a parent renders the parent with its blocks
+	replacing the blocks of the same name. Text outside of blocks is ignored.
+	The parent may extend another template.
+	Template "base":
+		<title>{{%block title}}Site{{/title}}</title>{{%block body}}{{/body}}
+	Template "page":
+		{{%extends base}}
+		{{%block body}}<p>{{*a}}</p>{{/body}}
+	JSON:
+		{"a": "foo"}
+	Output of "page":
+		<title>Site</title><p>foo</p>
+
+	Loading templates.
+	Set.ParseDir, Set.ParseFS and Set.ParseGlob add a tree of templates to a
+	Set. Templates are named by their path relative to the directory without
+	the extension. Every template that fails to parse is reported in an
+	ErrorList and the rest are still added. Set.OnLoad is called with every
+	template parsed from a file, for example to call AutoEscape.
+	In development a Reloader polls the directory and swaps changed templates
+	into the Set, keeping the last good version if a template fails to parse.
+	Go:
+		set := stem.NewSet()
+		set.OnLoad((*stem.Template).AutoEscape)
+		err := set.ParseDir("templates", "*.tmpl")
+		r := stem.NewDirReloader(set, "templates", "*.tmpl")
+		r.OnError = func(err error) { log.Print(err) }
+		r.Start()
+	Template "templates/pages/index.tmpl":
+		{{>emails/header}}
+
+	Limits.
+	ExecuteOptions can limit templates that aren't trusted. Each limit stops
+	execution with its own ErrorKind.
+	Go:
+		set.SetOptions(stem.ExecuteOptions{
+			MaxOutputBytes:  1 << 20, // ErrOutputLimit
+			MaxNodes:        100000,  // ErrNodeLimit
+			MaxIterations:   10000,   // ErrIterationLimit
+			MaxIncludeDepth: 10,      // ErrIncludeDepth
+		})
+
+	Command line.
+	The stem command renders a template without writing Go. Templates in the
+	-I directories can be included. The data is JSON from -d or stdin.
+	Shell:
+		stem render -t page.tmpl -d data.json -I includes -filter noblank,trimleft
+
+	Lint.
+	Lint reports every syntax error in a directory of templates, includes of
+	templates that don't exist, include cycles, partials that aren't included
+	and symbols that aren't in sample data or a JSON Schema. The stem lint
+	command runs it and can write JSON for CI.
+	Shell:
+		stem lint -json -partials "_*" -data sample.json templates "*.tmpl"
+
+	Formatting.
+	Format rewrites a template in the canonical format. Space in tags which
+	the parser ignores is normalized, so "{{* a }}" is kept because the key is
+	" a ". Comments and delimiter changes are kept. Text outside of
+	tags isn't changed because it's output. The stem fmt command works like
+	gofmt, -l lists the files that aren't formatted and -w rewrites them.
+	Go:
+		out, err := stem.Format(src)
+	Shell:
+		stem fmt -w templates/*.tmpl
+
+	Code generation.
+	The stemc command writes Go source with the templates in a bundle, so they
+	don't have to be shipped with the program. There is a function for each
+	template, named after its path, which executes it with the Templates set.
+	Shell:
+		stemc -pkg templates -autoescape -o templates/templates.go src *.tmpl
+	Go:
+		templates.Templates.Funcs(funcs)
+		err := templates.EmailsHeader(ctx, w, data)
+
+	Bundles.
+	Parsed templates can be encoded at build time and loaded at start up
+	without parsing. The encoding has a version and a checksum. Formatters
+	aren't encoded so call Funcs after loading.
+	Go:
+		b, err := set.MarshalBinary()
+		...
+		set := stem.NewSet()
+		err = set.UnmarshalBinary(b)
+
 	Change delimiters.
 	This can be used when your document contains the default delimiters.
 	JSON:
@@ -103,5 +323,18 @@ Package stem implements a templating system.
 		{{*a}}{{=[[ ]]}}[[*b]][[=<< >>]]<<*c>>
 	Output:
 		foobarbaz
+
+	Escaping.
+	After Template.AutoEscape is called print tags are escaped based on where
+	they appear in the HTML document. Included templates and blocks are escaped
+	for where the include or block tag is. It's an error if the context after a
+	section depends on the data, for example "{{?a}}<script>{{/?}}". In JS code
+	the output of the json formatter is a JS value instead of a string.
+	JSON:
+		{"a": "<b>", "b": "javascript:alert(1)", "c": "<i>foo</i>"}
+	Template:
+		<p title="{{*a}}">{{*a}}</p><a href="{{*b}}">{{&c}}</a>
+	Output:
+		<p title="&lt;b&gt;">&lt;b&gt;</p><a href="#ZstemZ"><i>foo</i></a>
 */
 package stem
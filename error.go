@@ -0,0 +1,131 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"fmt"
+)
+
+// ErrorKind describes the type of an Error.
+type ErrorKind int
+
+const (
+	// ErrSyntax is a malformed tag, name, pipeline or expression.
+	ErrSyntax ErrorKind = iota
+
+	// ErrUnclosed is a section without an end tag.
+	ErrUnclosed
+
+	// ErrUnopened is an end tag without a section.
+	ErrUnopened
+
+	// ErrUnmatched is an end tag with a different name than the section.
+	ErrUnmatched
+
+	// ErrDepth is a template with sections nested too deep, or includes
+	// nested too deep when executing.
+	ErrDepth
+
+	// ErrExec is an error returned by a formatter.
+	ErrExec
+
+	// ErrNotFound is a template that isn't in the Set.
+	ErrNotFound
+
+	// ErrCycle is a template that would always include itself.
+	ErrCycle
+
+	// ErrMissing is a symbol or include that isn't defined when executing with
+	// MissingError, or a symbol that isn't in the data given to Lint.
+	ErrMissing
+
+	// ErrOutputLimit is output longer than ExecuteOptions.MaxOutputBytes.
+	ErrOutputLimit
+
+	// ErrNodeLimit is more nodes evaluated than ExecuteOptions.MaxNodes.
+	ErrNodeLimit
+
+	// ErrIterationLimit is more section repetitions than
+	// ExecuteOptions.MaxIterations.
+	ErrIterationLimit
+
+	// ErrIncludeDepth is includes nested deeper than
+	// ExecuteOptions.MaxIncludeDepth.
+	ErrIncludeDepth
+
+	// ErrUnused is a partial that no template includes, found by Lint.
+	ErrUnused
+
+	// ErrEscape is a section that AutoEscape can't escape because its
+	// branches, or its repetitions, end in different HTML contexts.
+	ErrEscape
+)
+
+// Error is returned when parsing or executing a template fails.
+type Error struct {
+	Kind ErrorKind // Kind of error.
+	Name string    // Name of the template, may be empty.
+	Line int       // Line of the tag starting at 1, 0 if unknown.
+	Col  int       // Col is the byte offset in the line starting at 1.
+	Tag  string    // Tag is the source of the tag, may be empty.
+	Err  error     // Err describes the error.
+}
+
+// Error returns the error in the form "name:line:col: err: tag".
+func (e *Error) Error() string {
+	s := e.Name
+	if e.Line > 0 {
+		s += fmt.Sprintf(":%v:%v", e.Line, e.Col)
+	}
+	if s != "" {
+		s += ": "
+	}
+	s += e.Err.Error()
+	if e.Tag != "" {
+		s += ": " + e.Tag
+	}
+	return s
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// String returns the name of the kind.
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrSyntax:
+		return "syntax"
+	case ErrUnclosed:
+		return "unclosed"
+	case ErrUnopened:
+		return "unopened"
+	case ErrUnmatched:
+		return "unmatched"
+	case ErrDepth:
+		return "depth"
+	case ErrExec:
+		return "exec"
+	case ErrNotFound:
+		return "not found"
+	case ErrCycle:
+		return "cycle"
+	case ErrMissing:
+		return "missing"
+	case ErrOutputLimit:
+		return "output limit"
+	case ErrNodeLimit:
+		return "node limit"
+	case ErrIterationLimit:
+		return "iteration limit"
+	case ErrIncludeDepth:
+		return "include depth"
+	case ErrUnused:
+		return "unused"
+	case ErrEscape:
+		return "escape"
+	}
+	return "unknown"
+}
@@ -0,0 +1,143 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		src  string // src is the template.
+		want Error  // want this error, Err is ignored.
+	}{
+		{
+			src:  "a\n  {{#b}}",
+			want: Error{Kind: ErrUnclosed, Name: "x", Line: 2, Col: 3, Tag: "{{#b}}"},
+		},
+		{
+			src:  "{{#a}}\n{{/b}}",
+			want: Error{Kind: ErrUnmatched, Name: "x", Line: 2, Col: 1, Tag: "{{/b}}"},
+		},
+		{
+			src:  "ab{{/a}}",
+			want: Error{Kind: ErrUnopened, Name: "x", Line: 1, Col: 3, Tag: "{{/a}}"},
+		},
+		{
+			src:  "{{=[[ ]]}}\n[[*a.]]",
+			want: Error{Kind: ErrSyntax, Name: "x", Line: 2, Col: 1, Tag: "[[*a.]]"},
+		},
+		{
+			src:  "{{?a ==}}{{/?}}",
+			want: Error{Kind: ErrSyntax, Name: "x", Line: 1, Col: 1, Tag: "{{?a ==}}"},
+		},
+		{
+			src:  "a\nb{{~a}}",
+			want: Error{Kind: ErrSyntax, Name: "x", Line: 2, Col: 2},
+		},
+		{
+			src:  "{{+a}}{{:else}}{{:else}}{{/a}}",
+			want: Error{Kind: ErrSyntax, Name: "x", Line: 1, Col: 16, Tag: "{{:else}}"},
+		},
+	}
+	for _, test := range tests {
+		_, err := parse("x", test.src)
+		var got *Error
+		if !errors.As(err, &got) {
+			t.Fatalf("src %q, got error %v, want *Error", test.src, err)
+		}
+		got.Err = nil
+		if *got != test.want {
+			t.Fatalf("src %q, got %+v, want %+v", test.src, *got, test.want)
+		}
+	}
+}
+
+func TestExecuteError(t *testing.T) {
+	boom := errors.New("boom")
+	tmpl, err := ParseFile("testdata/fail.tmpl")
+	if err != nil {
+		t.Fatalf("couldn't parse template: %v", err)
+	}
+	tmpl.Funcs(FuncMap{
+		"fail": func(s string) (string, error) { return "", boom },
+	})
+	err = tmpl.Execute(bytes.NewBuffer(nil), map[string]interface{}{})
+	if got, want := err.Error(), "fail.tmpl:2:4: formatter \"fail\": boom: {{*a|fail}}"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if !errors.Is(err, boom) {
+		t.Fatalf("got %v, want to wrap %v", err, boom)
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	tests := []struct {
+		src  string   // src is the template.
+		want []string // want these errors.
+		tree int      // tree is the number of nodes in the tree.
+	}{
+		{
+			src:  "{{#a}}{{*b}}{{/a}}",
+			tree: 1,
+		},
+		{
+			src: "{{#a}}\n{{/b}}{{*c.}}{{/d}}{{:else}}\n{{+e}}",
+			want: []string{
+				"x:2:1: unmatched tag, expecting end of {{#a}}: {{/b}}",
+				"x:2:7: empty key in \"c.\": {{*c.}}",
+				"x:2:14: unopened scope: {{/d}}",
+				"x:2:20: else outside of scope: {{:else}}",
+				"x:3:1: unclosed scope: {{+e}}",
+			},
+			tree: 3,
+		},
+		{
+			src: "{{#a.}}x{{:else}}y{{/a.}}{{~b}}{{=[[}}{{:x}}{{%block c}}{{:else}}{{:else}}{{/c}}",
+			want: []string{
+				"x:1:1: empty key in \"a.\": {{#a.}}",
+				"x:1:26: unrecognized tag {{~",
+				"x:1:32: malformed tag: {{=[[}}",
+				"x:1:39: unrecognized tag: {{:x}}",
+				"x:1:57: else in block: {{:else}}",
+				"x:1:66: else in block: {{:else}}",
+			},
+			tree: 3,
+		},
+		{
+			src: "{{?a}}{{%define b}}{{/b}}{{%extends c}}{{:else}}{{:else}}{{/?}}{{%block d}}{{/d}}{{%block d}}{{/d}}",
+			want: []string{
+				"x:1:7: define inside of scope: {{%define b}}",
+				"x:1:26: extends inside of scope: {{%extends c}}",
+				"x:1:49: duplicate else: {{:else}}",
+				"x:1:82: duplicate block: {{%block d}}",
+			},
+			tree: 3,
+		},
+		{
+			src:  "{{*a}}{{",
+			want: []string{"x:1:7: incomplete tag"},
+			tree: 2,
+		},
+	}
+	for _, test := range tests {
+		tree, errs := parseAll("x", test.src)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Fatalf("src %q, got %q, want %q", test.src, got, test.want)
+		}
+		if len(tree) != test.tree {
+			t.Fatalf("src %q, got %v nodes, want %v", test.src, len(tree), test.tree)
+		}
+		if _, err := parse("x", test.src); (err == nil) != (errs == nil) {
+			t.Fatalf("src %q, got error %v from parse", test.src, err)
+		}
+	}
+}
@@ -0,0 +1,633 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// escaper is a function applied to the output of a print tag.
+type escaper int
+
+const (
+	escHTML     escaper = iota // HTML text or quoted attribute value.
+	escAttr                    // Unquoted attribute value or inside a tag.
+	escJS                      // JS code, value is output as a literal.
+	escJSStr                   // Inside a JS string literal.
+	escCSS                     // CSS in a <style> element or style attribute.
+	escURL                     // Start of a URL, scheme is checked.
+	escURLPath                 // URL after the scheme.
+	escURLQuery                // URL query or fragment.
+	escJSON                    // JS code after the json formatter.
+)
+
+// unsafeURL replaces a URL with a scheme other than http, https or mailto.
+const unsafeURL = "#ZstemZ"
+
+// jsonReplacer escapes the characters in JSON which have meaning to HTML or
+// end a line in JS. They can only be in strings where a \u escape means the
+// same.
+var jsonReplacer = strings.NewReplacer("<", `\u003C`, ">", `\u003E`, "&", `\u0026`, "\u2028", `\u2028`, "\u2029", `\u2029`)
+
+// Regexps for escapers.
+var (
+	jsNumber  = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+	urlScheme = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:`)
+)
+
+// escape returns s escaped for the context.
+func (e escaper) escape(s string) string {
+	switch e {
+	case escHTML:
+		return html.EscapeString(s)
+	case escAttr:
+		return escapeAttr(s)
+	case escJS:
+		if jsNumber.MatchString(s) || s == "true" || s == "false" || s == "null" {
+			return s
+		}
+		return `"` + escapeJSStr(s) + `"`
+	case escJSStr:
+		return escapeJSStr(s)
+	case escCSS:
+		return escapeCSS(s)
+	case escURL:
+		if scheme := urlScheme.FindString(s); scheme != "" {
+			switch strings.ToLower(scheme) {
+			case "http:", "https:", "mailto:":
+			default:
+				return unsafeURL
+			}
+		}
+		return normalizeURL(s)
+	case escURLPath:
+		return normalizeURL(s)
+	case escURLQuery:
+		return url.QueryEscape(s)
+	case escJSON:
+		// Valid JSON is a JS literal. The formatter may have been replaced
+		// so anything else is quoted.
+		if json.Valid([]byte(s)) {
+			return jsonReplacer.Replace(s)
+		}
+		return escJS.escape(s)
+	}
+	panic(fmt.Sprintf("unknown escaper %v, programmer error", int(e)))
+}
+
+// escapeAttr replaces every character that could end an unquoted attribute
+// value with a numeric character reference.
+func escapeAttr(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case ' ', '\t', '\n', '\f', '\r', '"', '\'', '`', '=', '<', '>', '&', '/':
+			fmt.Fprintf(&b, "&#x%X;", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// escapeCSS hex escapes everything that is not alphanumeric.
+func escapeCSS(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r < utf8.RuneSelf && !isAlnum(byte(r)) {
+			fmt.Fprintf(&b, "\\%X ", r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// escapeJSStr escapes s so it can be placed inside of a quoted JS string. The
+// characters which have meaning to HTML are escaped so the result is safe in
+// both a <script> element and an event handler attribute. "$", "{" and "}"
+// are escaped so "${" can't start a substitution in a template literal.
+func escapeJSStr(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '"', '\'', '`', '<', '>', '&', '$', '{', '}', '\u2028', '\u2029':
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			if r < ' ' {
+				fmt.Fprintf(&b, `\u%04X`, r)
+				continue
+			}
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// normalizeURL percent encodes bytes which are not allowed in a URL.
+func normalizeURL(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAlnum(c) || strings.IndexByte("-._~:/?#[]@!$&'()*+,;=%", c) != -1 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// HTML parser states used to determine the context of a print tag.
+const (
+	stText      = iota // Between tags.
+	stTagName          // After "<" or "</".
+	stTag              // Inside a tag between attributes.
+	stAttrName         // Inside an attribute name.
+	stAfterName        // After an attribute name.
+	stBeforeVal        // After "=".
+	stVal              // Inside an attribute value.
+	stComment          // Inside "<!--".
+	stRawText          // Inside a <script> or <style> element.
+)
+
+// Attribute types.
+const (
+	attrNone = iota
+	attrCSS
+	attrJS
+	attrURL
+)
+
+// JS states, only string literals are tracked.
+const (
+	jsCode = iota
+	jsDQ
+	jsSQ
+	jsBQ
+)
+
+// Attributes which contain a URL.
+var urlAttr = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"codebase":   true,
+	"formaction": true,
+	"href":       true,
+	"longdesc":   true,
+	"poster":     true,
+	"src":        true,
+	"usemap":     true,
+}
+
+// htmlContext tracks where in an HTML document we are.
+type htmlContext struct {
+	state   int    // state is the HTML parser state.
+	tag     string // tag is the name of the current element.
+	closing bool   // closing is true when in an end tag.
+	attr    int    // attr is the type of the current attribute.
+	delim   byte   // delim of the attribute value, 0 if unquoted.
+	val     string // val is the attribute value seen so far.
+	js      int    // js is the state of the JS in a script or attribute.
+	jsEsc   bool   // jsEsc is true after a backslash in a JS string.
+}
+
+// contexts are copies of the tree of an auto-escaped template, or of one of
+// its blocks, escaped for a context they're executed in other than the one
+// they were escaped in. They're made the first time they're needed.
+type contexts struct {
+	mu    sync.Mutex
+	trees map[contextKey]escapedTree
+}
+
+// escapedTree is a copy of a tree escaped for a context, or the error if it
+// couldn't be escaped.
+type escapedTree struct {
+	nodes []node
+	err   error
+}
+
+// contextKey identifies an escaped copy. The block is nil for the tree of the
+// template.
+type contextKey struct {
+	block *nodeBlock
+	ctx   htmlContext
+}
+
+// start returns the context with the fields that don't affect escaping
+// cleared, so the text context is always the zero value.
+func (c htmlContext) start() htmlContext {
+	if c.state == stText {
+		return htmlContext{}
+	}
+	return c
+}
+
+// same returns true if the contexts escape the text and print tags that
+// follow them the same way.
+func (c htmlContext) same(d htmlContext) bool {
+	return c.canonical() == d.canonical()
+}
+
+// canonical returns the context with the attribute value cleared unless it
+// affects escaping. Only what part of a URL the value ends in matters.
+func (c htmlContext) canonical() htmlContext {
+	c = c.start()
+	switch {
+	case c.state == stAttrName:
+		// The value is the attribute name.
+	case c.attr == attrURL && (c.state == stBeforeVal || c.state == stVal):
+		switch {
+		case c.val == "":
+		case strings.ContainsAny(c.val, "?#"):
+			c.val = "?"
+		default:
+			c.val = "/"
+		}
+	default:
+		c.val = ""
+	}
+	return c
+}
+
+// escapedIn returns the nodes of the block, or the tree of the template if b
+// is nil, escaped for the context of the include or block tag they're executed
+// for. The context is nil if the tag isn't auto-escaped, then the nodes are
+// returned as they are. An error is returned if the nodes can't be escaped in
+// the context.
+func (tmpl *Template) escapedIn(b *nodeBlock, c *htmlContext) ([]node, error) {
+	nodes, start := tmpl.tree, htmlContext{}
+	if b != nil {
+		nodes = b.nodes
+		if b.ctx != nil {
+			start = b.ctx.start()
+		}
+	}
+	if tmpl.esc == nil || c == nil || c.start() == start {
+		return nodes, nil
+	}
+	key := contextKey{block: b, ctx: c.start()}
+	tmpl.esc.mu.Lock()
+	defer tmpl.esc.mu.Unlock()
+	if tree, ok := tmpl.esc.trees[key]; ok {
+		return tree.nodes, tree.err
+	}
+	tree := escapedTree{nodes: cloneTree(nodes)}
+	ctx := key.ctx
+	if err := autoEscape(tree.nodes, &ctx); err != nil {
+		err.Name = tmpl.name
+		tree.nodes, tree.err = nil, err
+	}
+	if tmpl.esc.trees == nil {
+		tmpl.esc.trees = make(map[contextKey]escapedTree)
+	}
+	tmpl.esc.trees[key] = tree
+	return tree.nodes, tree.err
+}
+
+// cloneTree returns a copy of the tree which can be escaped without changing
+// the original. Strings and expressions are shared.
+func cloneTree(tree []node) []node {
+	if tree == nil {
+		return nil
+	}
+	c := make([]node, len(tree))
+	for i, n := range tree {
+		switch nt := n.(type) {
+		case *nodeArray:
+			cp := *nt
+			cp.nodes, cp.alt = cloneTree(nt.nodes), cloneTree(nt.alt)
+			c[i] = &cp
+		case *nodeBlock:
+			cp := *nt
+			cp.nodes = cloneTree(nt.nodes)
+			c[i] = &cp
+		case *nodeEach:
+			cp := *nt
+			cp.nodes, cp.alt = cloneTree(nt.nodes), cloneTree(nt.alt)
+			c[i] = &cp
+		case *nodeIf:
+			cp := *nt
+			cp.nodes, cp.alt = cloneTree(nt.nodes), cloneTree(nt.alt)
+			c[i] = &cp
+		case *nodeIfdef:
+			cp := *nt
+			cp.nodes, cp.alt = cloneTree(nt.nodes), cloneTree(nt.alt)
+			c[i] = &cp
+		case *nodeIfndef:
+			cp := *nt
+			cp.nodes, cp.alt = cloneTree(nt.nodes), cloneTree(nt.alt)
+			c[i] = &cp
+		case *nodeInclude:
+			cp := *nt
+			c[i] = &cp
+		case *nodeObject:
+			cp := *nt
+			cp.nodes, cp.alt = cloneTree(nt.nodes), cloneTree(nt.alt)
+			c[i] = &cp
+		case *nodePrint:
+			cp := *nt
+			c[i] = &cp
+		default:
+			c[i] = n
+		}
+	}
+	return c
+}
+
+// autoEscape recursively sets the escapers for every print node and the
+// context of every include and block. The branches of a section are escaped
+// starting in the same context and must end in the same context, and the body
+// of an array or each section must end in the context it started in, so the
+// context after a section doesn't depend on the data. Includes are assumed to
+// leave the context unchanged.
+func autoEscape(tree []node, c *htmlContext) *Error {
+	for _, n := range tree {
+		switch nt := n.(type) {
+		case *nodeArray:
+			if err := escapeSection(nt.pos, nt.nodes, nt.alt, true, c); err != nil {
+				return err
+			}
+		case *nodeBlock:
+			ctx := *c
+			nt.ctx = &ctx
+			if err := autoEscape(nt.nodes, c); err != nil {
+				return err
+			}
+		case *nodeEach:
+			if err := escapeSection(nt.pos, nt.nodes, nt.alt, true, c); err != nil {
+				return err
+			}
+		case *nodeIf:
+			if err := escapeSection(nt.pos, nt.nodes, nt.alt, false, c); err != nil {
+				return err
+			}
+		case *nodeIfdef:
+			if err := escapeSection(nt.pos, nt.nodes, nt.alt, false, c); err != nil {
+				return err
+			}
+		case *nodeIfndef:
+			if err := escapeSection(nt.pos, nt.nodes, nt.alt, false, c); err != nil {
+				return err
+			}
+		case *nodeInclude:
+			ctx := *c
+			nt.ctx = &ctx
+		case *nodeObject:
+			if err := escapeSection(nt.pos, nt.nodes, nt.alt, false, c); err != nil {
+				return err
+			}
+		case *nodePrint:
+			if !nt.raw {
+				nt.esc = c.escapers()
+				if l := len(nt.pipe); l > 0 && nt.pipe[l-1].name == "json" {
+					for i, e := range nt.esc {
+						if e == escJS {
+							nt.esc[i] = escJSON
+						}
+					}
+				}
+			}
+		case *nodeString:
+			c.write(nt.val)
+		}
+	}
+	return nil
+}
+
+// escapeSection escapes the nodes and the else nodes of a section starting in
+// the context c, and sets c to the context after the section. If loop is true
+// the nodes may be repeated.
+func escapeSection(p pos, nodes, alt []node, loop bool, c *htmlContext) *Error {
+	body, other := *c, *c
+	if err := autoEscape(nodes, &body); err != nil {
+		return err
+	}
+	if err := autoEscape(alt, &other); err != nil {
+		return err
+	}
+	var err error
+	switch {
+	case loop && !body.same(*c):
+		err = errors.New("section ends in a different context than it starts in")
+	case !body.same(other):
+		err = errors.New("section and else end in different contexts")
+	}
+	if err != nil {
+		return &Error{Kind: ErrEscape, Line: p.line, Col: p.col, Tag: p.tag, Err: err}
+	}
+	*c = body
+	return nil
+}
+
+// escapers returns the escapers needed for the current context.
+func (c *htmlContext) escapers() []escaper {
+	switch c.state {
+	case stText, stComment:
+		return []escaper{escHTML}
+	case stTagName, stTag, stAttrName, stAfterName:
+		return []escaper{escAttr}
+	case stRawText:
+		if c.tag == "style" {
+			return []escaper{escCSS}
+		}
+		return []escaper{c.jsEscaper()}
+	}
+	var esc []escaper
+	switch c.attr {
+	case attrCSS:
+		esc = append(esc, escCSS)
+	case attrJS:
+		esc = append(esc, c.jsEscaper())
+	case attrURL:
+		switch {
+		case c.state == stBeforeVal || c.val == "":
+			esc = append(esc, escURL)
+		case strings.ContainsAny(c.val, "?#"):
+			esc = append(esc, escURLQuery)
+		default:
+			esc = append(esc, escURLPath)
+		}
+	}
+	if c.state == stVal && c.delim != 0 {
+		return append(esc, escHTML)
+	}
+	return append(esc, escAttr)
+}
+
+func (c *htmlContext) jsEscaper() escaper {
+	if c.js == jsCode {
+		return escJS
+	}
+	return escJSStr
+}
+
+// endTag is called at the ">" of a tag.
+func (c *htmlContext) endTag() {
+	if !c.closing && (c.tag == "script" || c.tag == "style") {
+		c.state = stRawText
+		c.js = jsCode
+		return
+	}
+	c.state = stText
+}
+
+// writeJS tracks string literals in JS.
+func (c *htmlContext) writeJS(b byte) {
+	if c.jsEsc {
+		c.jsEsc = false
+		return
+	}
+	switch c.js {
+	case jsCode:
+		switch b {
+		case '"':
+			c.js = jsDQ
+		case '\'':
+			c.js = jsSQ
+		case '`':
+			c.js = jsBQ
+		}
+	case jsDQ, jsSQ, jsBQ:
+		switch {
+		case b == '\\':
+			c.jsEsc = true
+		case b == '"' && c.js == jsDQ, b == '\'' && c.js == jsSQ, b == '`' && c.js == jsBQ:
+			c.js = jsCode
+		}
+	}
+}
+
+// write advances the context past a string literal in the template.
+func (c *htmlContext) write(s string) {
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch c.state {
+		case stText:
+			switch {
+			case strings.HasPrefix(s[i:], "<!--"):
+				c.state = stComment
+				i += 3
+			case strings.HasPrefix(s[i:], "</") && i+2 < len(s) && isAlnum(s[i+2]):
+				c.state, c.tag, c.closing = stTagName, "", true
+				i++
+			case b == '<' && i+1 < len(s) && isAlnum(s[i+1]):
+				c.state, c.tag, c.closing = stTagName, "", false
+			}
+		case stTagName:
+			switch {
+			case isAlnum(b):
+				c.tag += strings.ToLower(string(b))
+			case b == '>':
+				c.endTag()
+			default:
+				c.state = stTag
+			}
+		case stTag, stAfterName:
+			switch {
+			case b == '>':
+				c.endTag()
+			case b == '=' && c.state == stAfterName:
+				c.state = stBeforeVal
+			case isSpace(b) || b == '/':
+			default:
+				c.state, c.val = stAttrName, string(b)
+			}
+		case stAttrName:
+			switch {
+			case b == '=':
+				c.state = stBeforeVal
+			case b == '>':
+				c.endTag()
+			case isSpace(b):
+				c.state = stAfterName
+			default:
+				c.val += string(b)
+				continue
+			}
+			c.attr = attrType(c.val)
+			c.val = ""
+			c.js = jsCode
+		case stBeforeVal:
+			switch {
+			case b == '>':
+				c.endTag()
+			case b == '"' || b == '\'':
+				c.state, c.delim = stVal, b
+			case isSpace(b):
+			default:
+				c.state, c.delim = stVal, 0
+				i--
+			}
+		case stVal:
+			switch {
+			case c.delim != 0 && b == c.delim:
+				c.state = stTag
+			case c.delim == 0 && isSpace(b):
+				c.state = stTag
+			case c.delim == 0 && b == '>':
+				c.endTag()
+			default:
+				c.val += string(b)
+				if c.attr == attrJS {
+					c.writeJS(b)
+				}
+			}
+		case stComment:
+			if strings.HasPrefix(s[i:], "-->") {
+				c.state = stText
+				i += 2
+			}
+		case stRawText:
+			end := "</" + c.tag
+			if len(s)-i >= len(end) && strings.EqualFold(s[i:i+len(end)], end) {
+				c.state, c.closing = stTagName, true
+				i += len(end) - 1
+				continue
+			}
+			if c.tag == "script" {
+				c.writeJS(b)
+			}
+		}
+	}
+}
+
+// attrType returns the type of the attribute with the specified name.
+func attrType(name string) int {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return attrJS
+	case name == "style":
+		return attrCSS
+	case urlAttr[name]:
+		return attrURL
+	}
+	return attrNone
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
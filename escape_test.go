@@ -0,0 +1,285 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestAutoEscape(t *testing.T) {
+	tests := []struct {
+		name string // name of test printed with errors.
+		tmpl string // tmpl is the template.
+		data string // data is JSON combined with the template.
+		want string // want this output.
+	}{
+		{
+			name: "text",
+			tmpl: "<p>{{*a}}</p>",
+			data: `{"a": "<script>&"}`,
+			want: "<p>&lt;script&gt;&amp;</p>",
+		},
+		{
+			name: "raw",
+			tmpl: "<p>{{&a}}</p>",
+			data: `{"a": "<b>"}`,
+			want: "<p><b></p>",
+		},
+		{
+			name: "quoted attribute",
+			tmpl: `<p title="{{*a}}" class='{{*a}}'>`,
+			data: `{"a": "\"'"}`,
+			want: `<p title="&#34;&#39;" class='&#34;&#39;'>`,
+		},
+		{
+			name: "unquoted attribute",
+			tmpl: `<p title={{*a}}>`,
+			data: `{"a": "x onclick=y"}`,
+			want: `<p title=x&#x20;onclick&#x3D;y>`,
+		},
+		{
+			name: "url",
+			tmpl: `<a href="{{*a}}">`,
+			data: `{"a": "http://x.com/a b"}`,
+			want: `<a href="http://x.com/a%20b">`,
+		},
+		{
+			name: "url unsafe scheme",
+			tmpl: `<a href="{{*a}}">`,
+			data: `{"a": "JavaScript:alert(1)"}`,
+			want: `<a href="#ZstemZ">`,
+		},
+		{
+			name: "url query",
+			tmpl: `<a href="/s?q={{*a}}">`,
+			data: `{"a": "a&b=c"}`,
+			want: `<a href="/s?q=a%26b%3Dc">`,
+		},
+		{
+			name: "script code",
+			tmpl: "<script>var a = {{*a}}, b = {{*b}};</script>{{*a}}",
+			data: `{"a": "</script>", "b": "1.5"}`,
+			want: `<script>var a = "\u003C/script\u003E", b = 1.5;</script>&lt;/script&gt;`,
+		},
+		{
+			name: "template literal",
+			tmpl: "<script>var a = `{{*a}}`;</script><a onclick=\"f(`{{*a}}`)\">",
+			data: `{"a": "${alert(1)}"}`,
+			want: "<script>var a = `\\u0024\\u007Balert(1)\\u007D`;</script><a onclick=\"f(`\\u0024\\u007Balert(1)\\u007D`)\">",
+		},
+		{
+			name: "json in script",
+			tmpl: `<script>var o = {{*o|json}}, s = "{{*o|json}}";</script><a onclick="f({{*o|json}})">`,
+			data: `{"o": {"a": [1, "</script>"]}}`,
+			want: `<script>var o = {"a":[1,"\u003c/script\u003e"]}, s = "\u007B\u0022a\u0022:[1,\u0022\\u003c/script\\u003e\u0022]\u007D";</script><a onclick="f({&#34;a&#34;:[1,&#34;\u003c/script\u003e&#34;]})">`,
+		},
+		{
+			name: "script string",
+			tmpl: `<script>var a = "{{*a}}";</script>`,
+			data: `{"a": "\"\\"}`,
+			want: `<script>var a = "\u0022\\";</script>`,
+		},
+		{
+			name: "event handler",
+			tmpl: `<a onclick="f('{{*a}}')">`,
+			data: `{"a": "');g('"}`,
+			want: `<a onclick="f('\u0027);g(\u0027')">`,
+		},
+		{
+			name: "style",
+			tmpl: `<style>p { color: {{*a}} }</style><p style="color: {{*a}}">`,
+			data: `{"a": "red;x:y"}`,
+			want: `<style>p { color: red\3B x\3A y }</style><p style="color: red\3B x\3A y">`,
+		},
+		{
+			name: "comment",
+			tmpl: "<!-- <a href='{{*a}}'> -->",
+			data: `{"a": "<"}`,
+			want: "<!-- <a href='&lt;'> -->",
+		},
+		{
+			name: "section",
+			tmpl: `<a href="{{#a}}{{*}}{{/a}}">`,
+			data: `{"a": ["javascript:x"]}`,
+			want: `<a href="#ZstemZ">`,
+		},
+	}
+	for _, test := range tests {
+		tmpl, err := Parse(test.tmpl)
+		if err != nil {
+			t.Fatalf("couldn't parse template: %v", err)
+		}
+		if err := tmpl.AutoEscape(); err != nil {
+			t.Fatalf("test %q, couldn't escape: %v", test.name, err)
+		}
+		got := bytes.NewBuffer(nil)
+		if err := tmpl.ExecuteJSON(got, test.data); err != nil {
+			t.Fatalf("couldn't execute template: %v", err)
+		}
+		if got.String() != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.name, got.String(), test.want)
+		}
+	}
+}
+
+func TestAutoEscapeInclude(t *testing.T) {
+	tests := []struct {
+		name  string            // name of test printed with errors.
+		tmpls map[string]string // tmpls are the templates, "page" is executed.
+		data  string            // data is JSON combined with the templates.
+		want  string            // want this output.
+	}{
+		{
+			name:  "script",
+			tmpls: map[string]string{"page": "<script>var x = {{>v}};</script>{{>v}}", "v": "{{*a}}"},
+			data:  `{"a": "1;alert(1)"}`,
+			want:  `<script>var x = "1;alert(1)";</script>1;alert(1)`,
+		},
+		{
+			name:  "url attribute",
+			tmpls: map[string]string{"page": `<a href="{{>v}}">{{>v}}</a>`, "v": "{{*a}}"},
+			data:  `{"a": "javascript:alert(1)"}`,
+			want:  `<a href="#ZstemZ">javascript:alert(1)</a>`,
+		},
+		{
+			name:  "unquoted attribute",
+			tmpls: map[string]string{"page": `<p title={{>v}}>`, "v": "{{*a}}"},
+			data:  `{"a": "x onclick=y"}`,
+			want:  `<p title=x&#x20;onclick&#x3D;y>`,
+		},
+		{
+			name:  "nested include",
+			tmpls: map[string]string{"page": "<script>{{>v}}</script>", "v": "{{#a}}{{>w}}{{/a}}", "w": "{{*}},"},
+			data:  `{"a": ["<", "b"]}`,
+			want:  `<script>"\u003C","b",</script>`,
+		},
+		{
+			name: "block",
+			tmpls: map[string]string{
+				"base": "<script>var x = {{%block v}}{{*b}}{{/v}};</script><p>{{%block w}}{{/w}}</p>",
+				"page": "{{%extends base}}{{%block v}}{{*a}}{{/v}}{{%block w}}{{*a}}{{/w}}",
+			},
+			data: `{"a": "1;alert(1)", "b": "<"}`,
+			want: `<script>var x = "1;alert(1)";</script><p>1;alert(1)</p>`,
+		},
+		{
+			name: "included layout",
+			tmpls: map[string]string{
+				"page":  `<a href="{{>child}}">`,
+				"base":  "{{%block v}}{{/v}}",
+				"child": "{{%extends base}}{{%block v}}{{*a}}{{/v}}",
+			},
+			data: `{"a": "javascript:x"}`,
+			want: `<a href="#ZstemZ">`,
+		},
+	}
+	for _, test := range tests {
+		set := NewSet()
+		for name, text := range test.tmpls {
+			tmpl := MustParse(text)
+			tmpl.SetName(name)
+			if err := tmpl.AutoEscape(); err != nil {
+				t.Fatalf("test %q, couldn't escape: %v", test.name, err)
+			}
+			if err := set.Add(tmpl); err != nil {
+				t.Fatalf("test %q, couldn't add template: %v", test.name, err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			// The second execution uses the cached copies.
+			got := bytes.NewBuffer(nil)
+			if err := set.ExecuteJSON(got, "page", test.data); err != nil {
+				t.Fatalf("test %q, couldn't execute template: %v", test.name, err)
+			}
+			if got.String() != test.want {
+				t.Fatalf("test %q, got %q, want %q", test.name, got.String(), test.want)
+			}
+		}
+	}
+}
+
+func TestAutoEscapeSection(t *testing.T) {
+	tmpl := MustParse("{{+x}}<b>{{:else}}<script>var a = {{*y}};</script>{{/x}}{{#a}}<i title=\"{{*}}\">{{/a}}")
+	if err := tmpl.AutoEscape(); err != nil {
+		t.Fatalf("couldn't escape: %v", err)
+	}
+	got := bytes.NewBuffer(nil)
+	if err := tmpl.ExecuteJSON(got, `{"y": "1;alert(1)", "a": ["<"]}`); err != nil {
+		t.Fatalf("couldn't execute: %v", err)
+	}
+	if want := `<script>var a = "1;alert(1)";</script><i title="&lt;">`; got.String() != want {
+		t.Fatalf("got %q, want %q", got.String(), want)
+	}
+}
+
+func TestAutoEscapeErrors(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"<script>{{+x}}</script>{{:else}}var a = {{*y}};{{/x}}", "x:1:9: section and else end in different contexts: {{+x}}"},
+		{"{{?a}}<script>{{/?}}{{*b}}", "x:1:1: section and else end in different contexts: {{?a}}"},
+		{"<p {{$o}}title=\"{{/o}}>", "x:1:4: section and else end in different contexts: {{$o}}"},
+		{"{{#a}}<a href=\"{{/a}}\">", "x:1:1: section ends in a different context than it starts in: {{#a}}"},
+		{"<script>{{@a}}'{{/a}}</script>", "x:1:9: section ends in a different context than it starts in: {{@a}}"},
+		{"{{%define d}}{{?a}}<style>{{/?}}{{/d}}", "d:1:14: section and else end in different contexts: {{?a}}"},
+	}
+	for _, test := range tests {
+		tmpl := MustParse(test.tmpl)
+		tmpl.SetName("x")
+		err := tmpl.AutoEscape()
+		var e *Error
+		if !errors.As(err, &e) || e.Kind != ErrEscape || err.Error() != test.want {
+			t.Fatalf("test %q, got error %v, want %q", test.tmpl, err, test.want)
+		}
+		if tmpl.esc != nil {
+			t.Fatalf("test %q, template changed by failed escape", test.tmpl)
+		}
+	}
+
+	// Branches that end in the same part of a URL are the same.
+	tmpl := MustParse("<a href=\"/{{?a}}x{{:else}}y{{/?}}{{*b}}\">")
+	if err := tmpl.AutoEscape(); err != nil {
+		t.Fatalf("couldn't escape: %v", err)
+	}
+
+	// A template that can't be escaped where it's included is an error when
+	// executing.
+	set := NewSet()
+	for name, text := range map[string]string{"page": "<script>{{>v}}</script>", "v": "{{?a}}'{{/?}}"} {
+		tmpl := MustParse(text)
+		tmpl.SetName(name)
+		if err := tmpl.AutoEscape(); err != nil {
+			t.Fatalf("couldn't escape %v: %v", name, err)
+		}
+		if err := set.Add(tmpl); err != nil {
+			t.Fatalf("couldn't add %v: %v", name, err)
+		}
+	}
+	err := set.ExecuteJSON(ioutil.Discard, "page", `{}`)
+	if want := "v:1:1: section and else end in different contexts: {{?a}}"; err == nil || err.Error() != want {
+		t.Fatalf("got error %v, want %q", err, want)
+	}
+}
+
+func TestEscapeJSON(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"{\"a\":\"<\u2028\"}", `{"a":"\u003C\u2028"}`},
+		{`[1,true,null]`, `[1,true,null]`},
+		// A replaced json formatter may not return JSON.
+		{`alert(1)`, `"alert(1)"`},
+		{`{"a":1};alert(1)`, `"\u007B\u0022a\u0022:1\u007D;alert(1)"`},
+	}
+	for _, test := range tests {
+		if got := escJSON.escape(test.s); got != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.s, got, test.want)
+		}
+	}
+}
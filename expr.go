@@ -0,0 +1,330 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// expr is a node in the expression tree of a condition.
+type expr interface {
+	// eval returns the value of the expression.
+	eval(sym *symtab) reflect.Value
+}
+
+// exprBinary is a comparison or a boolean operator.
+type exprBinary struct {
+	op   string
+	x, y expr
+}
+
+// exprLit is a string, float64, bool or nil literal.
+type exprLit struct {
+	val interface{}
+}
+
+// exprNot negates the truthiness of an expression.
+type exprNot struct {
+	x expr
+}
+
+// exprPath is a symbol looked up in the symbol table.
+type exprPath struct {
+	name string
+}
+
+var (
+	valTrue  = reflect.ValueOf(true)
+	valFalse = reflect.ValueOf(false)
+)
+
+func boolValue(b bool) reflect.Value {
+	if b {
+		return valTrue
+	}
+	return valFalse
+}
+
+func (e *exprBinary) eval(sym *symtab) reflect.Value {
+	switch e.op {
+	case "&&":
+		return boolValue(truthy(e.x.eval(sym)) && truthy(e.y.eval(sym)))
+	case "||":
+		return boolValue(truthy(e.x.eval(sym)) || truthy(e.y.eval(sym)))
+	}
+	x, y := indirect(e.x.eval(sym)), indirect(e.y.eval(sym))
+	switch e.op {
+	case "==":
+		return boolValue(equal(x, y))
+	case "!=":
+		return boolValue(!equal(x, y))
+	}
+	c, ok := compare(x, y)
+	if !ok {
+		return valFalse
+	}
+	switch e.op {
+	case "<":
+		return boolValue(c < 0)
+	case "<=":
+		return boolValue(c <= 0)
+	case ">":
+		return boolValue(c > 0)
+	case ">=":
+		return boolValue(c >= 0)
+	}
+	panic(fmt.Sprintf("unknown operator %q, programmer error", e.op))
+}
+
+func (e *exprLit) eval(sym *symtab) reflect.Value {
+	return reflect.ValueOf(e.val)
+}
+
+func (e *exprNot) eval(sym *symtab) reflect.Value {
+	return boolValue(!truthy(e.x.eval(sym)))
+}
+
+func (e *exprPath) eval(sym *symtab) reflect.Value {
+	return sym.Value(e.name)
+}
+
+// number returns v as a float64 if it is a number.
+func number(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// compare returns -1, 0 or 1 if x is less than, equal to or greater than y. It
+// returns false unless both are numbers or both are strings.
+func compare(x, y reflect.Value) (int, bool) {
+	if a, ok := number(x); ok {
+		b, ok := number(y)
+		switch {
+		case !ok:
+			return 0, false
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	}
+	if x.Kind() == reflect.String && y.Kind() == reflect.String {
+		return strings.Compare(x.String(), y.String()), true
+	}
+	return 0, false
+}
+
+// equal compares values using JSON types. Undefined is equal to null.
+func equal(x, y reflect.Value) bool {
+	if !x.IsValid() || !y.IsValid() {
+		return !x.IsValid() && !y.IsValid()
+	}
+	if c, ok := compare(x, y); ok {
+		return c == 0
+	}
+	if x.Kind() == reflect.Bool && y.Kind() == reflect.Bool {
+		return x.Bool() == y.Bool()
+	}
+	if x.CanInterface() && y.CanInterface() {
+		return reflect.DeepEqual(x.Interface(), y.Interface())
+	}
+	return false
+}
+
+// exprParser is a recursive descent parser for conditions.
+//
+//	or      = and {"||" and}
+//	and     = not {"&&" not}
+//	not     = "!" not | cmp
+//	cmp     = primary [("==" | "!=" | "<" | "<=" | ">" | ">=") primary]
+//	primary = "(" or ")" | string | number | "true" | "false" | "null" | path
+type exprParser struct {
+	src string // src is the full expression, used for errors.
+	s   string // s is the remaining input.
+}
+
+// parseExpr parses the expression of a condition tag.
+func parseExpr(src string) (expr, error) {
+	if strings.TrimSpace(src) == "" {
+		// Array element.
+		return &exprPath{}, nil
+	}
+	p := &exprParser{src: src, s: src}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.s != "" {
+		return nil, p.error("unexpected %q", p.s)
+	}
+	return e, nil
+}
+
+func (p *exprParser) error(format string, a ...interface{}) error {
+	return fmt.Errorf("%v in expression %q", fmt.Sprintf(format, a...), p.src)
+}
+
+// skip white space.
+func (p *exprParser) skip() {
+	p.s = strings.TrimLeft(p.s, " \t\r\n")
+}
+
+// accept consumes the operator if it is next.
+func (p *exprParser) accept(op string) bool {
+	p.skip()
+	if !strings.HasPrefix(p.s, op) {
+		return false
+	}
+	p.s = p.s[len(op):]
+	return true
+}
+
+func (p *exprParser) or() (expr, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = &exprBinary{op: "||", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) and() (expr, error) {
+	x, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		y, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		x = &exprBinary{op: "&&", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) not() (expr, error) {
+	if p.skip(); strings.HasPrefix(p.s, "!") && !strings.HasPrefix(p.s, "!=") {
+		p.s = p.s[1:]
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{x: x}, nil
+	}
+	return p.cmp()
+}
+
+func (p *exprParser) cmp() (expr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	// Longer operators are checked first so "<=" isn't mistaken for "<".
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.accept(op) {
+			y, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			return &exprBinary{op: op, x: x, y: y}, nil
+		}
+	}
+	return x, nil
+}
+
+func (p *exprParser) primary() (expr, error) {
+	p.skip()
+	switch {
+	case p.s == "":
+		return nil, p.error("unexpected end")
+	case p.s[0] == '(':
+		p.s = p.s[1:]
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.error("missing )")
+		}
+		return x, nil
+	case p.s[0] == '"' || p.s[0] == '`':
+		q, err := strconv.QuotedPrefix(p.s)
+		if err != nil {
+			return nil, p.error("malformed string")
+		}
+		p.s = p.s[len(q):]
+		val, _ := strconv.Unquote(q)
+		return &exprLit{val: val}, nil
+	case p.s[0] == '-' || '0' <= p.s[0] && p.s[0] <= '9':
+		i := strings.IndexFunc(p.s[1:], func(r rune) bool {
+			return !('0' <= r && r <= '9' || r == '.' || r == 'e' || r == 'E' || r == '+' || r == '-')
+		}) + 1
+		if i == 0 {
+			i = len(p.s)
+		}
+		f, err := strconv.ParseFloat(p.s[:i], 64)
+		if err != nil {
+			return nil, p.error("malformed number %q", p.s[:i])
+		}
+		p.s = p.s[i:]
+		return &exprLit{val: f}, nil
+	}
+	name := p.path()
+	if name == "" {
+		return nil, p.error("unexpected %q", p.s)
+	}
+	switch name {
+	case "true":
+		return &exprLit{val: true}, nil
+	case "false":
+		return &exprLit{val: false}, nil
+	case "null":
+		return &exprLit{val: nil}, nil
+	}
+	if _, err := parsePath(name); err != nil {
+		return nil, p.error("%v", err)
+	}
+	return &exprPath{name: name}, nil
+}
+
+// path consumes a symbol name. Quoted keys in brackets may contain operators.
+func (p *exprParser) path() string {
+	i := 0
+	for i < len(p.s) {
+		c := p.s[i]
+		if c == '[' && i+1 < len(p.s) && (p.s[i+1] == '"' || p.s[i+1] == '`') {
+			q, err := strconv.QuotedPrefix(p.s[i+1:])
+			if err != nil {
+				break
+			}
+			i += 1 + len(q)
+			continue
+		}
+		if strings.IndexByte(" \t\r\n()!=<>&|", c) != -1 {
+			break
+		}
+		i++
+	}
+	name := p.s[:i]
+	p.s = p.s[i:]
+	return name
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	got, err := parseExpr(`!a.b && (c == "x" || d >= -1.5) && e != null`)
+	if err != nil {
+		t.Fatalf("couldn't parse expression: %v", err)
+	}
+	want := &exprBinary{
+		op: "&&",
+		x: &exprBinary{
+			op: "&&",
+			x:  &exprNot{x: &exprPath{name: "a.b"}},
+			y: &exprBinary{
+				op: "||",
+				x:  &exprBinary{op: "==", x: &exprPath{name: "c"}, y: &exprLit{val: "x"}},
+				y:  &exprBinary{op: ">=", x: &exprPath{name: "d"}, y: &exprLit{val: -1.5}},
+			},
+		},
+		y: &exprBinary{op: "!=", x: &exprPath{name: "e"}, y: &exprLit{val: nil}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+	for _, src := range []string{"a ==", "(a", "a b", `a == "b`, "1.2.3", "a..b", "&& a"} {
+		if _, err := parseExpr(src); err == nil {
+			t.Fatalf("expected error for %q", src)
+		}
+	}
+}
+
+func TestEvalExpr(t *testing.T) {
+	st := newsymtab(map[string]interface{}{
+		"s": "active",
+		"n": 3,
+		"f": 2.5,
+		"b": false,
+		"z": nil,
+		"o": map[string]interface{}{"k": "v"},
+		"a": []interface{}{1},
+	})
+	tests := []struct {
+		src  string // src is the expression.
+		want bool   // want the expression to be this.
+	}{
+		{`s == "active"`, true},
+		{`s != "active"`, false},
+		{`n == 3`, true},
+		{`n > f && f > 2`, true},
+		{`n <= 2 || f < 2`, false},
+		{`"a" < "b"`, true},
+		{`s > 1`, false},
+		{`b == false`, true},
+		{`!b`, true},
+		{`z == null && undefined == null`, true},
+		{`o.k == "v"`, true},
+		{`a && !(n == 3)`, false},
+		{`n == "3"`, false},
+	}
+	for _, test := range tests {
+		e, err := parseExpr(test.src)
+		if err != nil {
+			t.Fatalf("couldn't parse expression %q: %v", test.src, err)
+		}
+		if got := truthy(e.eval(st)); got != test.want {
+			t.Fatalf("expression %q, got %v, want %v", test.src, got, test.want)
+		}
+	}
+}
@@ -35,12 +35,24 @@ func filter(tree []node, filters Filter) {
 		switch nt := n.(type) {
 		case *nodeArray:
 			filter(nt.nodes, filters)
+			filter(nt.alt, filters)
+		case *nodeBlock:
+			filter(nt.nodes, filters)
+		case *nodeEach:
+			filter(nt.nodes, filters)
+			filter(nt.alt, filters)
+		case *nodeIf:
+			filter(nt.nodes, filters)
+			filter(nt.alt, filters)
 		case *nodeIfdef:
 			filter(nt.nodes, filters)
+			filter(nt.alt, filters)
 		case *nodeIfndef:
 			filter(nt.nodes, filters)
+			filter(nt.alt, filters)
 		case *nodeObject:
 			filter(nt.nodes, filters)
+			filter(nt.alt, filters)
 		case *nodeString:
 			if filters & TrimLeftSpace != 0 {
 				nt.val = leftSpace.ReplaceAllString(nt.val, "\n")
@@ -0,0 +1,183 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Format returns the canonical source of a template. Space in tags which the
+// parser ignores is normalized: a single space separates the words of
+// directives, includes and conditions, and pipelines are written like
+// "a|default \"x\" 1". Space in the names of sections and of print tags
+// without formatters is part of the key so it's kept. Text outside of tags,
+// comments and delimiter changes are kept as they are because text is output.
+// Formatting canonical source doesn't change it. An error is returned if the
+// template doesn't parse.
+func Format(src []byte) ([]byte, error) {
+	if _, err := parse("", string(src)); err != nil {
+		return nil, err
+	}
+	l := newLexer("", string(src))
+	l.keep = true
+	var (
+		b    strings.Builder
+		ends []string // ends are the names of the end tags of open sections.
+	)
+	ldel, rdel := l.ldel, l.rdel
+	for {
+		t, err := l.Next()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		if t.tt == ttString {
+			b.WriteString(t.val)
+			continue
+		}
+		val := t.val
+		switch t.tt {
+		case ttArray, ttEach, ttIfdef, ttIfndef, ttObject:
+			ends = append(ends, val)
+		case ttDirective:
+			keyword, name := directive(val)
+			val = keyword + " " + name
+			if keyword != "extends" {
+				ends = append(ends, name)
+			}
+		case ttEnd:
+			if val != "?" {
+				val = ends[len(ends)-1]
+			}
+			ends = ends[:len(ends)-1]
+		case ttIf:
+			e, err := parseExpr(val)
+			if err != nil {
+				return nil, err
+			}
+			val = formatExpr(e, 0)
+			ends = append(ends, val)
+		case ttInclude:
+			n, err := parseInclude(val)
+			if err != nil {
+				return nil, err
+			}
+			val = formatInclude(n)
+		case ttPrint, ttRaw:
+			name, pipe, err := parsePipeline(val)
+			if err != nil {
+				return nil, err
+			}
+			val = formatPipeline(name, pipe)
+		}
+		// A delimiter change is written with the delimiters before it.
+		b.WriteString(ldel)
+		b.WriteByte(tagChar(t.tt))
+		b.WriteString(val)
+		b.WriteString(rdel)
+		ldel, rdel = l.ldel, l.rdel
+	}
+	return []byte(b.String()), nil
+}
+
+// formatInclude returns the source of an include tag value.
+func formatInclude(n *nodeInclude) string {
+	s := []string{n.name}
+	if n.scope != nil {
+		s = append(s, formatExpr(n.scope, precPrimary))
+	}
+	for _, a := range n.args {
+		s = append(s, a.name+"="+formatExpr(a.val, precPrimary))
+	}
+	return strings.Join(s, " ")
+}
+
+// Operator precedence of expressions, from lowest to highest.
+const (
+	precOr = iota
+	precAnd
+	precNot
+	precCmp
+	precPrimary
+)
+
+// formatExpr returns the source of an expression. The expression is in
+// parentheses if its precedence is lower than prec.
+func formatExpr(e expr, prec int) string {
+	var s string
+	p := precPrimary
+	switch e := e.(type) {
+	case *exprBinary:
+		switch e.op {
+		case "||":
+			p = precOr
+			s = formatExpr(e.x, precOr) + " || " + formatExpr(e.y, precAnd)
+		case "&&":
+			p = precAnd
+			s = formatExpr(e.x, precAnd) + " && " + formatExpr(e.y, precNot)
+		default:
+			p = precCmp
+			s = formatExpr(e.x, precPrimary) + " " + e.op + " " + formatExpr(e.y, precPrimary)
+		}
+	case *exprLit:
+		switch v := e.val.(type) {
+		case nil:
+			s = "null"
+		case string:
+			s = strconv.Quote(v)
+		case float64:
+			s = strconv.FormatFloat(v, 'g', -1, 64)
+		default:
+			s = fmt.Sprint(v)
+		}
+	case *exprNot:
+		p = precNot
+		if _, ok := e.x.(*exprBinary); ok {
+			// "!(a > 1)" is clearer than the equivalent "!a > 1".
+			s = "!" + formatExpr(e.x, precPrimary)
+		} else {
+			s = "!" + formatExpr(e.x, precNot)
+		}
+	case *exprPath:
+		s = e.name
+	default:
+		panic(fmt.Sprintf("unknown expression %T, programmer error", e))
+	}
+	if p < prec {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// formatPipeline returns the source of a print tag that parses to the same
+// name and pipeline.
+func formatPipeline(name string, pipe []*call) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, c := range pipe {
+		b.WriteString("|")
+		b.WriteString(c.name)
+		for _, a := range c.args {
+			b.WriteString(" ")
+			switch v := a.(type) {
+			case string:
+				b.WriteString(strconv.Quote(v))
+			case float64:
+				s := strconv.FormatFloat(v, 'g', -1, 64)
+				if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+					// Keep the float from being parsed as an int.
+					s += ".0"
+				}
+				b.WriteString(s)
+			default:
+				fmt.Fprint(&b, v)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"", ""},
+		{"  a\n\tb  ", "  a\n\tb  "},
+		{"{{* a }}{{& b\n}}{{* a | upper }}", "{{* a }}{{& b\n}}{{*a|upper}}"},
+		{"{{*a | upper|default  `x`   1 2.50 true}}", "{{*a|upper|default \"x\" 1 2.5 true}}"},
+		{"{{*a|default 1.0}}", "{{*a|default 1.0}}"},
+		{"{{# items }}{{*@index}}{{:else}}none{{/ items }}", "{{# items }}{{*@index}}{{:else}}none{{/ items }}"},
+		{"{{@a}}{{/a}}{{$b}}{{/b}}{{+c}}{{/c}}{{-d}}{{/d}}", "{{@a}}{{/a}}{{$b}}{{/b}}{{+c}}{{/c}}{{-d}}{{/d}}"},
+		{"{{? a>1&&!( b==\"x\"||c ) }}y{{/ a>1&&!( b==\"x\"||c ) }}", "{{?a > 1 && !(b == \"x\" || c)}}y{{/a > 1 && !(b == \"x\" || c)}}"},
+		{"{{?(a||b)&&c}}{{/?}}{{?a||(b||c)}}{{/?}}{{?!(a>1)}}{{/?}}{{?!!a}}{{/?}}", "{{?(a || b) && c}}{{/?}}{{?a || (b || c)}}{{/?}}{{?!(a > 1)}}{{/?}}{{?!!a}}{{/?}}"},
+		{"{{?a==null||b!=-1.5e3||c==`y`}}{{/?}}", "{{?a == null || b != -1500 || c == \"y\"}}{{/?}}"},
+		{"{{?}}{{*}}{{/?}}", "{{?}}{{*}}{{/?}}"},
+		{"{{> card  user.a\tsize=`small`  n=1 }}{{>b}}", "{{>card user.a size=\"small\" n=1}}{{>b}}"},
+		{"{{%  extends  base }}{{% block  content}}x{{/content}}", "{{%extends base}}{{%block content}}x{{/content}}"},
+		{"{{%define  item }}<li>{{*name}}</li>{{/item}}", "{{%define item}}<li>{{*name}}</li>{{/item}}"},
+		{"a{{! keep  this\n comment }}b", "a{{! keep  this\n comment }}b"},
+		{"{{=<% %>}}<%* a|trim %><%! c %><%={{ }}%>{{* b }}", "{{=<% %>}}<%*a|trim%><%! c %><%={{ }}%>{{* b }}"},
+		{"{{*a[\"x y\"]}}{{#a[\"b\"].c}}{{/a[\"b\"].c}}", "{{*a[\"x y\"]}}{{#a[\"b\"].c}}{{/a[\"b\"].c}}"},
+	}
+	for _, test := range tests {
+		got, err := Format([]byte(test.src))
+		if err != nil {
+			t.Fatalf("test %q, couldn't format: %v", test.src, err)
+		}
+		if string(got) != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.src, got, test.want)
+		}
+		again, err := Format(got)
+		if err != nil {
+			t.Fatalf("test %q, couldn't format again: %v", test.src, err)
+		}
+		if !bytes.Equal(again, got) {
+			t.Fatalf("test %q, not idempotent, got %q, want %q", test.src, again, got)
+		}
+	}
+}
+
+func TestFormatSameOutput(t *testing.T) {
+	src := "{{* a|trim }}{{#items}}<{{* name | upper }}>{{? price  >  2 }} dear{{/?}}{{:else}}none{{/items}}{{=<% %>}}<%! c %><%& b|trim %>"
+	JSON := `{"a": "x", "b": "<y>", "items": [{"name": "p", "price": 3}, {"name": "q", "price": 1}]}`
+	formatted, err := Format([]byte(src))
+	if err != nil {
+		t.Fatalf("couldn't format: %v", err)
+	}
+	var want, got bytes.Buffer
+	if err := MustParse(src).ExecuteJSON(&want, JSON); err != nil {
+		t.Fatalf("couldn't execute: %v", err)
+	}
+	if err := MustParse(string(formatted)).ExecuteJSON(&got, JSON); err != nil {
+		t.Fatalf("couldn't execute formatted: %v", err)
+	}
+	if want.String() != "x<P> dear<Q><y>" || got.String() != want.String() {
+		t.Fatalf("got %q, want %q", got.String(), want.String())
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"{{#a}}", ":1:1: unclosed scope: {{#a}}"},
+		{"{{*a|}}", ":1:1: missing formatter in \"a|\": {{*a|}}"},
+		{"{{?a >}}{{/?}}", ":1:1: unexpected end in expression \"a >\": {{?a >}}"},
+	}
+	for _, test := range tests {
+		_, err := Format([]byte(test.src))
+		if err == nil || err.Error() != test.want {
+			t.Fatalf("test %q, got %v, want %q", test.src, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FuncMap maps formatter names to functions. A formatter is used in a print tag
+// pipeline such as "{{*a|truncate 10|upper}}". The first parameter of the
+// function is the value being printed and the rest are the arguments in the
+// tag. The function must return one value, or a value and an error. A non-nil
+// error stops the execution of the template.
+type FuncMap map[string]interface{}
+
+// builtins are the formatters available to every template.
+var builtins = FuncMap{
+	"date":     fmtDate,
+	"default":  fmtDefault,
+	"html":     html.EscapeString,
+	"js":       escapeJSStr,
+	"json":     fmtJSON,
+	"lower":    strings.ToLower,
+	"trim":     strings.TrimSpace,
+	"truncate": fmtTruncate,
+	"upper":    strings.ToUpper,
+	"url":      url.QueryEscape,
+}
+
+// errorType is the type of the error interface.
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// call of a formatter in a pipeline.
+type call struct {
+	name string        // name of the formatter.
+	args []interface{} // args are string, int64, float64 or bool literals.
+}
+
+// checkFuncs panics if a function in the FuncMap can't be used as a formatter.
+func checkFuncs(funcs FuncMap) {
+	for name, fn := range funcs {
+		t := reflect.TypeOf(fn)
+		if t == nil || t.Kind() != reflect.Func {
+			panic(fmt.Sprintf("formatter %q is not a function", name))
+		}
+		if t.NumIn() == 0 {
+			panic(fmt.Sprintf("formatter %q must accept a value", name))
+		}
+		switch {
+		case t.NumOut() == 1:
+		case t.NumOut() == 2 && t.Out(1) == errorType:
+		default:
+			panic(fmt.Sprintf("formatter %q must return a value, or a value and an error", name))
+		}
+	}
+}
+
+// parsePipeline splits the value of a print tag in to the symbol name and the
+// formatters applied to it. Elements of the pipeline are separated by "|" and
+// arguments are separated by spaces.
+func parsePipeline(val string) (string, []*call, error) {
+	if !strings.Contains(val, "|") {
+		return val, nil, nil
+	}
+	var elems [][]interface{}
+	elem := []interface{}{}
+	for s := val; ; {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" || s[0] == '|' {
+			elems = append(elems, elem)
+			if s == "" {
+				break
+			}
+			elem = []interface{}{}
+			s = s[1:]
+			continue
+		}
+		if s[0] == '"' || s[0] == '`' {
+			q, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return "", nil, fmt.Errorf("malformed string in %q", val)
+			}
+			s = s[len(q):]
+			uq, _ := strconv.Unquote(q)
+			elem = append(elem, uq)
+			continue
+		}
+		i := strings.IndexAny(s, " \t\r\n|")
+		if i == -1 {
+			i = len(s)
+		}
+		lit := s[:i]
+		s = s[i:]
+		if len(elem) == 0 {
+			// Names are never converted.
+			elem = append(elem, lit)
+			continue
+		}
+		elem = append(elem, parseLiteral(lit))
+	}
+	var name string
+	if len(elems[0]) > 1 {
+		return "", nil, fmt.Errorf("unexpected argument in %q", val)
+	}
+	if len(elems[0]) == 1 {
+		name, _ = elems[0][0].(string)
+	}
+	var pipe []*call
+	for _, e := range elems[1:] {
+		if len(e) == 0 {
+			return "", nil, fmt.Errorf("missing formatter in %q", val)
+		}
+		fn, ok := e[0].(string)
+		if !ok {
+			return "", nil, fmt.Errorf("malformed formatter in %q", val)
+		}
+		pipe = append(pipe, &call{name: fn, args: e[1:]})
+	}
+	return name, pipe, nil
+}
+
+// parseLiteral converts an unquoted argument to a bool, int64 or float64. If it
+// is none of these it is returned as a string.
+func parseLiteral(lit string) interface{} {
+	switch lit {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if i, err := strconv.ParseInt(lit, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(lit, 64); err == nil {
+		return f
+	}
+	return lit
+}
+
+// convert v to type t so it can be passed to a formatter.
+func convert(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	if !v.IsValid() {
+		return reflect.Zero(t), nil
+	}
+	if v.Type().AssignableTo(t) {
+		return v, nil
+	}
+	e := indirect(v)
+	if !e.IsValid() {
+		return reflect.Zero(t), nil
+	}
+	if e.Type().AssignableTo(t) {
+		return e, nil
+	}
+	if t.Kind() == reflect.String {
+		return reflect.ValueOf(sprint(e)).Convert(t), nil
+	}
+	switch e.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return e.Convert(t), nil
+		}
+	case reflect.String:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i, err := strconv.ParseInt(e.String(), 10, 64)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return reflect.ValueOf(i).Convert(t), nil
+		case reflect.Float32, reflect.Float64:
+			f, err := strconv.ParseFloat(e.String(), 64)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return reflect.ValueOf(f).Convert(t), nil
+		case reflect.Bool:
+			b, err := strconv.ParseBool(e.String())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return reflect.ValueOf(b), nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("can't use %v as %v", e.Type(), t)
+}
+
+// apply calls the formatter with v as the first argument.
+func (c *call) apply(fn interface{}, v reflect.Value) (reflect.Value, error) {
+	f := reflect.ValueOf(fn)
+	t := f.Type()
+	n := len(c.args) + 1
+	if n < t.NumIn()-1 || !t.IsVariadic() && n != t.NumIn() {
+		return reflect.Value{}, fmt.Errorf("formatter %q wants %v arguments, got %v", c.name, t.NumIn()-1, len(c.args))
+	}
+	in := make([]reflect.Value, n)
+	for i := range in {
+		arg := v
+		if i > 0 {
+			arg = reflect.ValueOf(c.args[i-1])
+		}
+		var pt reflect.Type
+		if t.IsVariadic() && i >= t.NumIn()-1 {
+			pt = t.In(t.NumIn() - 1).Elem()
+		} else {
+			pt = t.In(i)
+		}
+		var err error
+		if in[i], err = convert(arg, pt); err != nil {
+			return reflect.Value{}, fmt.Errorf("formatter %q argument %v: %v", c.name, i, err)
+		}
+	}
+	out := f.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return reflect.Value{}, fmt.Errorf("formatter %q: %w", c.name, out[1].Interface().(error))
+	}
+	return out[0], nil
+}
+
+// fmtDate formats a time.Time, a RFC 3339 string or a unix timestamp with the
+// layout used by the time package. Undefined, null and a nil *time.Time are
+// formatted as "".
+func fmtDate(v interface{}, layout string) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case time.Time:
+		return t.Format(layout), nil
+	case *time.Time:
+		if t == nil {
+			return "", nil
+		}
+		return t.Format(layout), nil
+	case string:
+		tm, err := time.Parse(time.RFC3339, t)
+		if err != nil {
+			return "", err
+		}
+		return tm.Format(layout), nil
+	case float64:
+		return time.Unix(int64(t), 0).UTC().Format(layout), nil
+	case int:
+		return time.Unix(int64(t), 0).UTC().Format(layout), nil
+	case int64:
+		return time.Unix(t, 0).UTC().Format(layout), nil
+	}
+	return "", fmt.Errorf("can't use %T as date", v)
+}
+
+// fmtDefault returns d if v is undefined, null or an empty string.
+func fmtDefault(v interface{}, d interface{}) interface{} {
+	if v == nil || v == "" {
+		return d
+	}
+	return v
+}
+
+// fmtJSON returns the JSON encoding of v.
+func fmtJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// fmtTruncate returns the first n characters of s.
+func fmtTruncate(s string, n int) string {
+	if n < 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
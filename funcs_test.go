@@ -0,0 +1,153 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePipeline(t *testing.T) {
+	name, pipe, err := parsePipeline(`a.b | truncate 10|default "x | y" 1.5 true`)
+	if err != nil {
+		t.Fatalf("couldn't parse pipeline: %v", err)
+	}
+	want := []*call{
+		{name: "truncate", args: []interface{}{int64(10)}},
+		{name: "default", args: []interface{}{"x | y", 1.5, true}},
+	}
+	if name != "a.b" || !reflect.DeepEqual(pipe, want) {
+		t.Fatalf("got %q %v, want %q %v", name, pipe, "a.b", want)
+	}
+	for _, val := range []string{"a|", "a||upper", "a b|upper", `a|default "x`} {
+		if _, _, err := parsePipeline(val); err == nil {
+			t.Fatalf("expected error for %q", val)
+		}
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	tests := []struct {
+		name string // name of test printed with errors.
+		tmpl string // tmpl is the template.
+		data string // data is JSON combined with the template.
+		want string // want this output.
+	}{
+		{"upper", "{{*a|upper}}", `{"a": "foo"}`, "FOO"},
+		{"chain", "{{*a|trim|truncate 2|upper}}", `{"a": " foo "}`, "FO"},
+		{"default", `{{*a|default "x"}}{{*b|default "y"}}`, `{"b": "z"}`, "xz"},
+		{"html", "{{*a|html}}", `{"a": "<b>"}`, "&lt;b&gt;"},
+		{"url", "{{*a|url}}", `{"a": "a b&c"}`, "a+b%26c"},
+		{"js", "{{*a|js}}", `{"a": "'"}`, `\u0027`},
+		{"json", "{{*a|json}}", `{"a": {"b": [1, "c"]}}`, `{"b":[1,"c"]}`},
+		{"lower", "{{*a|lower}}", `{"a": "FOO"}`, "foo"},
+		{"date", `{{*a|date "2006-01-02"}}{{*b|date "15:04"}}`, `{"a": "2015-03-04T05:06:07Z", "b": 60}`, "2015-03-0400:01"},
+		{"array element", "{{#a}}{{*|upper}}{{/a}}", `{"a": ["x", "y"]}`, "XY"},
+		{"user", "{{*a|add 2|add 0.5}}", `{"a": 1}`, "3.5"},
+		{"user variadic", `{{*a|join "b" "c"}}`, `{"a": "a"}`, "a-b-c"},
+	}
+	for _, test := range tests {
+		tmpl, err := Parse(test.tmpl)
+		if err != nil {
+			t.Fatalf("couldn't parse template: %v", err)
+		}
+		tmpl.Funcs(FuncMap{
+			"add":  func(a, b float64) float64 { return a + b },
+			"join": func(s ...string) string { return strings.Join(s, "-") },
+		})
+		got := bytes.NewBuffer(nil)
+		if err := tmpl.ExecuteJSON(got, test.data); err != nil {
+			t.Fatalf("test %q, couldn't execute template: %v", test.name, err)
+		}
+		if got.String() != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.name, got.String(), test.want)
+		}
+	}
+}
+
+func TestFuncsDateStruct(t *testing.T) {
+	tmpl := MustParse(`{{*t|date "2006"}}`)
+	got := bytes.NewBuffer(nil)
+	data := struct {
+		T time.Time `json:"t"`
+	}{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := tmpl.Execute(got, data); err != nil {
+		t.Fatalf("couldn't execute template: %v", err)
+	}
+	if got, want := got.String(), "2015"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	nilTime := struct {
+		T *time.Time `json:"t"`
+	}{}
+	for _, data := range []interface{}{nilTime, nil} {
+		got.Reset()
+		if err := tmpl.Execute(got, data); err != nil {
+			t.Fatalf("data %#v, couldn't execute template: %v", data, err)
+		}
+		if got.String() != "" {
+			t.Fatalf("data %#v, got %q, want empty", data, got.String())
+		}
+	}
+}
+
+func TestFuncsError(t *testing.T) {
+	boom := errors.New("boom")
+	tmpl := MustParse("0{{*a|fail}}1")
+	tmpl.Funcs(FuncMap{
+		"fail": func(s string) (string, error) { return "", boom },
+	})
+	if err := tmpl.Execute(bytes.NewBuffer(nil), map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("got error %v, want %v", err, boom)
+	}
+	tmpl = MustParse("{{*a|nope}}")
+	if err := tmpl.Execute(bytes.NewBuffer(nil), map[string]interface{}{}); err == nil {
+		t.Fatal("expected error for unknown formatter")
+	}
+	tmpl = MustParse("{{*a|truncate}}")
+	if err := tmpl.Execute(bytes.NewBuffer(nil), map[string]interface{}{}); err == nil {
+		t.Fatal("expected error for missing argument")
+	}
+}
+
+func TestFuncsPanic(t *testing.T) {
+	for _, fn := range []interface{}{1, func() string { return "" }, func(string) (string, string) { return "", "" }} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected panic for %T", fn)
+				}
+			}()
+			MustParse("").Funcs(FuncMap{"f": fn})
+		}()
+	}
+}
+
+func TestSetFuncs(t *testing.T) {
+	set := NewSet()
+	set.Funcs(FuncMap{
+		"wrap": func(s string) string { return fmt.Sprintf("[%v]", s) },
+	})
+	foo := MustParse("{{*a|wrap}}{{>bar}}")
+	foo.SetName("foo")
+	set.Add(foo)
+	bar := MustParse("{{*a|wrap}}")
+	bar.SetName("bar")
+	bar.Funcs(FuncMap{
+		"wrap": func(s string) string { return fmt.Sprintf("(%v)", s) },
+	})
+	set.Add(bar)
+	got := bytes.NewBuffer(nil)
+	if err := set.Execute(got, "foo", map[string]interface{}{"a": "x"}); err != nil {
+		t.Fatalf("couldn't execute template: %v", err)
+	}
+	if got, want := got.String(), "[x](x)"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// bundleLine is the number of bytes of the bundle on a line of generated code.
+const bundleLine = 32
+
+// GenerateGo writes Go source for package pkg to w. The set is stored in the
+// source as encoded by MarshalBinary, so the templates aren't read or parsed
+// at run time. The generated package has a Templates variable with the set,
+// and for every template a function named after it, "emails/header" is named
+// EmailsHeader, which executes it like Set.ExecuteContext. Set options and
+// formatters with Templates.SetOptions and Templates.Funcs. Call
+// Template.Filter and Template.AutoEscape before adding the templates to the
+// set.
+func (s *Set) GenerateGo(w io.Writer, pkg string) error {
+	s.rwm.RLock()
+	var names []string
+	for name, t := range s.cache {
+		for ext := extends(t.tree); ext != nil; ext = extends(t.tree) {
+			parent := s.cache[ext.name]
+			if parent == nil {
+				s.rwm.RUnlock()
+				return fmt.Errorf("template %q extends %q which isn't in the set", t.name, ext.name)
+			}
+			t = parent
+		}
+		names = append(names, name)
+	}
+	s.rwm.RUnlock()
+	sort.Strings(names)
+	funcs := make(map[string]string)
+	used := map[string]string{"Templates": ""}
+	for _, name := range names {
+		fn := funcName(name)
+		if fn == "" {
+			return fmt.Errorf("template %q has no letters for a function name", name)
+		}
+		if other, ok := used[fn]; ok {
+			if fn == "Templates" {
+				return fmt.Errorf("template %q has the function name Templates which is the set", name)
+			}
+			return fmt.Errorf("templates %q and %q have the same function name %v", other, name, fn)
+		}
+		used[fn] = name
+		funcs[name] = fn
+	}
+	bundle, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by stemc. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %v\n\n", pkg)
+	fmt.Fprintf(&b, "import (\n\"context\"\n\"io\"\n\n\"github.com/sbunce/stem\"\n)\n\n")
+	fmt.Fprintf(&b, "// Templates is the set executed by the functions of the package.\n")
+	fmt.Fprintf(&b, "var Templates = func() *stem.Set {\n")
+	fmt.Fprintf(&b, "s := stem.NewSet()\n")
+	fmt.Fprintf(&b, "if err := s.UnmarshalBinary([]byte(templateBundle)); err != nil {\n")
+	fmt.Fprintf(&b, "panic(\"couldn't load templates, generate the code again: \" + err.Error())\n}\n")
+	fmt.Fprintf(&b, "return s\n}()\n\n")
+	for _, name := range names {
+		fn := funcs[name]
+		fmt.Fprintf(&b, "// %v executes the template %q.\n", fn, name)
+		fmt.Fprintf(&b, "func %v(ctx context.Context, w io.Writer, data interface{}) error {\n", fn)
+		fmt.Fprintf(&b, "return Templates.ExecuteContext(ctx, w, %q, data)\n}\n\n", name)
+	}
+	fmt.Fprintf(&b, "// templateBundle is the set encoded by stem.Set.MarshalBinary.\nconst templateBundle = \"\"")
+	for i := 0; i < len(bundle); i += bundleLine {
+		end := i + bundleLine
+		if end > len(bundle) {
+			end = len(bundle)
+		}
+		fmt.Fprintf(&b, " +\n%v", quoteBytes(bundle[i:end]))
+	}
+	fmt.Fprintf(&b, "\n")
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		panic(fmt.Sprintf("generated invalid code: %v, programmer error", err))
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// funcName returns the exported Go name for a template name.
+func funcName(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if b.Len() == 0 && !unicode.IsLetter(r) {
+			b.WriteString("T")
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// quoteBytes returns a Go string literal of b. Bytes that aren't printable
+// ASCII are hex escaped so the literal has the same bytes even when they
+// aren't UTF-8.
+func quoteBytes(b []byte) string {
+	var s strings.Builder
+	s.WriteByte('"')
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			s.WriteByte('\\')
+			s.WriteByte(c)
+		case c >= ' ' && c < 0x7f:
+			s.WriteByte(c)
+		default:
+			fmt.Fprintf(&s, `\x%02x`, c)
+		}
+	}
+	s.WriteByte('"')
+	return s.String()
+}
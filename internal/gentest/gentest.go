@@ -0,0 +1,8 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+// Package gentest tests that code generated by stemc renders the same output
+// as the templates it was generated from.
+package gentest
+
+//go:generate go run ../../cmd/stemc -pkg gentest -autoescape -o templates.go testdata *.tmpl
@@ -0,0 +1,143 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package gentest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sbunce/stem"
+)
+
+// load parses the templates like "stemc -autoescape testdata *.tmpl".
+func load(t *testing.T) *stem.Set {
+	set := stem.NewSet()
+	set.OnLoad((*stem.Template).AutoEscape)
+	if err := set.ParseDir("testdata", "*.tmpl"); err != nil {
+		t.Fatalf("couldn't load templates: %v", err)
+	}
+	return set
+}
+
+func TestUpToDate(t *testing.T) {
+	var got bytes.Buffer
+	if err := load(t).GenerateGo(&got, "gentest"); err != nil {
+		t.Fatalf("couldn't generate: %v", err)
+	}
+	want, err := ioutil.ReadFile("templates.go")
+	if err != nil {
+		t.Fatalf("couldn't read generated code: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Fatal("templates.go is out of date, run go generate")
+	}
+}
+
+var data = []string{
+	`{}`,
+	`{"title": "<Hello>", "body": "a & b", "html": "<b>x</b>", "url": "javascript:x", "n": 3}`,
+	`{"url": "/a b?c=d", "missing": "found", "title": "abcdef"}`,
+	`{"items": [{"name": "a", "price": 1}, {"name": "<b>", "price": 3}], "attrs": {"x": 1, "y": "z"}}`,
+	`{"items": [], "user": {"name": "bob", "admin": true}}`,
+	`{"user": {"name": "eve"}, "size": "huge"}`,
+	`{"name": "a", "children": [{"name": "b", "children": []}, {"name": "c", "children": [{"name": "d", "children": []}]}], "user": {"name": "u"}}`,
+}
+
+func TestGenerated(t *testing.T) {
+	set := load(t)
+	funcs := map[string]func(context.Context, io.Writer, interface{}) error{
+		"article":      Article,
+		"card":         Card,
+		"include":      Include,
+		"layouts/base": LayoutsBase,
+		"layouts/page": LayoutsPage,
+		"link":         Link,
+		"print":        Print,
+		"script":       Script,
+		"sections":     Sections,
+		"tree":         Tree,
+	}
+	options := []stem.ExecuteOptions{
+		{},
+		{MissingKey: stem.MissingError},
+		{MissingKey: stem.MissingKeep},
+		{MaxOutputBytes: 20},
+		{MaxNodes: 5},
+		{MaxIterations: 2},
+		{MaxIncludeDepth: 1},
+		{MaxDepth: 3},
+	}
+	defer Templates.SetOptions(stem.ExecuteOptions{})
+	for _, opts := range options {
+		set.SetOptions(opts)
+		Templates.SetOptions(opts)
+		for name, fn := range funcs {
+			for _, JSON := range data {
+				want := bytes.NewBuffer(nil)
+				wantErr := set.ExecuteJSON(want, name, JSON)
+				got := bytes.NewBuffer(nil)
+				var v map[string]interface{}
+				if err := json.Unmarshal([]byte(JSON), &v); err != nil {
+					t.Fatalf("couldn't unmarshal %v: %v", JSON, err)
+				}
+				gotErr := fn(context.Background(), got, v)
+				if fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+					t.Fatalf("test %q %+v %v, got error %v, want %v", name, opts, JSON, gotErr, wantErr)
+				}
+				if got.String() != want.String() {
+					t.Fatalf("test %q %+v %v, got %q, want %q", name, opts, JSON, got.String(), want.String())
+				}
+			}
+		}
+	}
+}
+
+type item struct {
+	Name  string  `json:"name"`
+	Price float64 `json:"price"`
+}
+
+type user struct {
+	Name  string `json:"name"`
+	Admin bool   `json:"admin"`
+}
+
+func TestGeneratedStruct(t *testing.T) {
+	set := load(t)
+	v := &struct {
+		Items []item         `json:"items"`
+		Attrs map[string]int `json:"attrs"`
+		User  *user          `json:"user"`
+		Title string         `json:"title"`
+		N     int            `json:"n"`
+	}{
+		Items: []item{{"a", 1}, {"<b>", 3}},
+		Attrs: map[string]int{"x": 1, "y": 2},
+		User:  &user{Name: "bob", Admin: true},
+		Title: "<Hello>",
+		N:     3,
+	}
+	tests := map[string]func(context.Context, io.Writer, interface{}) error{
+		"print":    Print,
+		"sections": Sections,
+	}
+	for name, fn := range tests {
+		want := bytes.NewBuffer(nil)
+		if err := set.Execute(want, name, v); err != nil {
+			t.Fatalf("test %q, couldn't execute: %v", name, err)
+		}
+		got := bytes.NewBuffer(nil)
+		if err := fn(context.Background(), got, v); err != nil {
+			t.Fatalf("test %q, couldn't execute generated code: %v", name, err)
+		}
+		if got.String() != want.String() {
+			t.Fatalf("test %q, got %q, want %q", name, got.String(), want.String())
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Code generated by stemc. DO NOT EDIT.
+
+package gentest
+
+import (
+	"context"
+	"io"
+
+	"github.com/sbunce/stem"
+)
+
+// Templates is the set executed by the functions of the package.
+var Templates = func() *stem.Set {
+	s := stem.NewSet()
+	if err := s.UnmarshalBinary([]byte(templateBundle)); err != nil {
+		panic("couldn't load templates, generate the code again: " + err.Error())
+	}
+	return s
+}()
+
+// Article executes the template "article".
+func Article(ctx context.Context, w io.Writer, data interface{}) error {
+	return Templates.ExecuteContext(ctx, w, "article", data)
+}
+
+// Card executes the template "card".
+func Card(ctx context.Context, w io.Writer, data interface{}) error {
+	return Templates.ExecuteContext(ctx, w, "card", data)
+}
+
+// Include executes the template "include".
+func Include(ctx context.Context, w io.Writer, data interface{}) error {
+	return Templates.ExecuteContext(ctx, w, "include", data)
+}
+
+// LayoutsBase executes the template "layouts/base".
+func LayoutsBase(ctx context.Context, w io.Writer, data interface{}) error {
+	return Templates.ExecuteContext(ctx, w, "layouts/base", data)
+}
+
+// LayoutsPage executes the template "layouts/page".
+func LayoutsPage(ctx context.Context, w io.Writer, data interface{}) error {
+	return Templates.ExecuteContext(ctx, w, "layouts/page", data)
+}
+
+// Link executes the template "link".
+func Link(ctx context.Context, w io.Writer, data interface{}) error {
+	return Templates.ExecuteContext(ctx, w, "link", data)
+}
+
+// Print executes the template "print".
+func Print(ctx context.Context, w io.Writer, data interface{}) error {
+	return Templates.ExecuteContext(ctx, w, "print", data)
+}
+
+// Script executes the template "script".
+func Script(ctx context.Context, w io.Writer, data interface{}) error {
+	return Templates.ExecuteContext(ctx, w, "script", data)
+}
+
+// Sections executes the template "sections".
+func Sections(ctx context.Context, w io.Writer, data interface{}) error {
+	return Templates.ExecuteContext(ctx, w, "sections", data)
+}
+
+// Tree executes the template "tree".
+func Tree(ctx context.Context, w io.Writer, data interface{}) error {
+	return Templates.ExecuteContext(ctx, w, "tree", data)
+}
+
+// templateBundle is the set encoded by stem.Set.MarshalBinary.
+const templateBundle = "" +
+	"stem\x02s\x00\x00\x00\x00\x00\x00\x0a\x07article\x00\x00\x00\x00\x00\x00\x01\x03\x04\x01\x01" +
+	"\x19{{%extends layouts/page}}\x0clayou" +
+	"ts/page\x02\x01\x1a\x12{{%block content}}\x07co" +
+	"ntent\x04\x0b\x09<article>\x0a\x015\x09{{*body}}\x04b" +
+	"ody\x00\x00\x0b\x0a</article>\x00\x04card\x00\x00\x00\x00\x00\x00\x01\x06\x0b" +
+	"\x01[\x0a\x01\x02\x09{{*name}}\x04name\x00\x00\x0b\x01 \x0a\x01\x0c\x17{{*" +
+	"size|default \"big\"}}\x04size\x01\x07defau" +
+	"lt\x01\x05\x03big\x00\x0b\x01]\x00\x07include\x00\x00\x00\x00\x00\x00\x01\x07\x08\x01i" +
+	"\x09{{>tree}}\x04tree\x04tree\x00\x00\x0b\x01|\x08\x01s\x1b{{>" +
+	"card user size=\"small\"}}\x16card us" +
+	"er size=\"small\"\x04card\x04\x04user\x01\x04size" +
+	"\x02\x05\x05small\x0b\x01|\x08\x01\x8f\x01\x0c{{>missing}}\x07mis" +
+	"sing\x07missing\x00\x00\x0b\x01\x0a\x00\x0clayouts/base\x00" +
+	"\x00\x00\x00\x00\x00\x01\x06\x0b\x0d<html><title>\x02\x01\x0e\x10{{%blo" +
+	"ck title}}\x05title\x02\x0b\x04Site\x0b\x08</title" +
+	">\x02\x014\x0f{{%block body}}\x04body\x04\x0b\x06<mai" +
+	"n>\x02\x01I\x12{{%block content}}\x07content" +
+	"\x01\x0b\x07</main>\x0b\x07</html>\x00\x0clayouts/pag" +
+	"e\x00\x00\x00\x00\x00\x00\x01\x04\x04\x01\x01\x19{{%extends layouts/" +
+	"base}}\x0clayouts/base\x02\x01\x1a\x10{{%block " +
+	"title}}\x05title\x02\x0a\x01*\x0a{{*title}}\x05tit" +
+	"le\x00\x00\x02\x01>\x12{{%block content}}\x07conte" +
+	"nt\x02\x08\x01P\x0e{{>card user}}\x09card user\x04" +
+	"card\x04\x04user\x00\x00\x04link\x00\x00\x00\x00\x00\x00\x01\x02\x0a\x01\x01\x08{{*" +
+	"url}}\x03url\x00\x00\x00\x05print\x00\x00\x00\x00\x00\x00\x01\x12\x0b\x04<h1>" +
+	"\x0a\x01\x05\x10{{*title|upper}}\x05title\x01\x05uppe" +
+	"r\x00\x00\x0b\x10</h1>\x0a<p title=\"\x0a\x02\x0b\x0a{{*titl" +
+	"e}}\x05title\x00\x00\x0b\x02\">\x0a\x02\x17\x09{{*body}}\x04bod" +
+	"y\x00\x00\x0b\x04</p>\x0a\x02$\x09{{&html}}\x04html\x00\x01\x0b\x0a\x0a" +
+	"<a href=\"\x0a\x03\x0a\x08{{*url}}\x03url\x00\x00\x0b\x08\">x" +
+	"</a>\x0a\x0a\x04\x01\x12{{*n|default 1.0}}\x01n\x01\x07d" +
+	"efault\x01\x07\x80\x80\x80\x80\x80\x80\x80\xf8?\x00\x0b\x01 \x0a\x04\x14\x1b{{*miss" +
+	"ing|default \"none\"}}\x07missing\x01\x07de" +
+	"fault\x01\x05\x04none\x00\x0b\x01 \x0a\x040\x15{{*title|tru" +
+	"ncate 3}}\x05title\x01\x08truncate\x01\x06\x06\x00\x0b\x01\x0a" +
+	"\x00\x06script\x00\x00\x00\x00\x00\x00\x01\x08\x0b\x10<script>var u " +
+	"= \x08\x01\x11\x09{{>link}}\x04link\x04link\x00\x00\x0b\x14;</" +
+	"script>\x0a<a href=\"\x08\x02\x0a\x09{{>link}}\x04l" +
+	"ink\x04link\x00\x00\x0b\x02\">\x08\x02\x15\x09{{>link}}\x04link" +
+	"\x04link\x00\x00\x0b\x05</a>\x0a\x00\x08sections\x00\x00\x00\x00\x00\x00\x01\x07" +
+	"\x01\x01\x01\x0a{{#items}}\x05items\x0b\x05\x01\x0b\x0b{{?@fir" +
+	"st}}\x06@first\x02\x0b\x04<ul>\x00\x04\x06@first\x0b\x04<li" +
+	">\x0a\x01$\x0c{{*@index1}}\x07@index1\x00\x00\x0b\x01/\x0a\x01" +
+	"1\x0c{{*@length}}\x07@length\x00\x00\x0b\x01 \x0a\x01>\x09{" +
+	"{*name}}\x04name\x00\x00\x05\x01G\x0e{{?price > 2}" +
+	"}\x09price > 2\x02\x0b\x05 dear\x02\x0b\x06 cheap\x01\x01>\x04" +
+	"\x05price\x02\x07\x80\x80\x80\x80\x80\x80\x80\x80@\x0b\x05</li>\x05\x01t\x0a{{?@" +
+	"last}}\x05@last\x02\x0b\x05</ul>\x00\x04\x05@last\x02\x0b\x08n" +
+	"o items\x0b\x01\x0a\x03\x02\x01\x0a{{@attrs}}\x05attrs\x05\x0a" +
+	"\x02\x0b\x09{{*@key}}\x04@key\x00\x00\x0b\x01=\x0a\x02\x15\x05{{*}}\x00" +
+	"\x00\x00\x0b\x01;\x00\x0b\x01\x0a\x09\x03\x01\x09{{$user}}\x04user\x04\x0a\x03\x0a\x09" +
+	"{{*name}}\x04name\x00\x00\x06\x03\x13\x0a{{+admin}}\x05a" +
+	"dmin\x02\x0b\x06 admin\x00\x07\x03-\x0a{{-admin}}\x05adm" +
+	"in\x02\x0b\x05 user\x00\x02\x0b\x04anon\x0b\x01\x0a\x00\x04tree\x00\x00\x00\x00\x00" +
+	"\x00\x01\x03\x0a\x01\x11\x09{{*name}}\x04name\x00\x00\x01\x01\x1a\x0d{{#ch" +
+	"ildren}}\x08children\x04\x05\x01'\x0b{{?@first}" +
+	"}\x06@first\x02\x0b\x01(\x00\x04\x06@first\x08\x019\x09{{>tree" +
+	"}}\x04tree\x04tree\x00\x00\x05\x01B\x0a{{?@last}}\x05@la" +
+	"st\x02\x0b\x01)\x00\x04\x05@last\x00\x00;H!p"
@@ -4,6 +4,7 @@
 package stem
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -12,14 +13,19 @@ import (
 type ttype int
 const (
 	ttArray ttype = iota
-	ttChangeDelim // Never returned by the lexer.
-	ttComment     // Never returned by the lexer.
+	ttChangeDelim // Only returned by the lexer if keep is true.
+	ttComment     // Only returned by the lexer if keep is true.
+	ttDirective
+	ttEach
+	ttElse
 	ttEnd
+	ttIf
 	ttIfdef
 	ttIfndef
 	ttInclude
 	ttObject
 	ttPrint
+	ttRaw
 	ttString
 )
 
@@ -34,15 +40,20 @@ type token struct {
 	tt   ttype  // tt is the token type.
 	val  string // val is the value of the token (name or string literal).
 	line int    // line number token starts on.
+	col  int    // col is the byte offset in the line the token starts on.
 }
 
 // lexer that operates on the raw template.
 type lexer struct {
-	name string // name of the template.
-	ldel string // ldel is the current left delimiter.
-	rdel string // rdel is the current right delimiter.
-	line int    // line is the current line.
-	src  string // src is the remaining input.
+	name string  // name of the template.
+	ldel string  // ldel is the current left delimiter.
+	rdel string  // rdel is the current right delimiter.
+	line int     // line is the current line.
+	col  int     // col is the current byte offset in the line.
+	src  string  // src is the remaining input.
+	all  bool    // all is true if parsing continues after errors.
+	keep bool    // keep is true if Next returns comments and delimiter changes.
+	errs []error // errs are the errors reported when all is true.
 }
 
 // Lookup map for token types.
@@ -50,18 +61,72 @@ var tagType = map[byte]ttype{
 	'#': ttArray,
 	'=': ttChangeDelim,
 	'!': ttComment,
+	'%': ttDirective,
+	'@': ttEach,
+	':': ttElse,
 	'/': ttEnd,
+	'?': ttIf,
 	'+': ttIfdef,
 	'-': ttIfndef,
 	'>': ttInclude,
 	'$': ttObject,
 	'*': ttPrint,
+	'&': ttRaw,
 }
 
 // Error returns an error that includes information about where the error
-// occurred.
-func (l *lexer) Error(a ...interface{}) error {
-	return fmt.Errorf("%v:%v %v", l.name, l.line, fmt.Sprint(a...))
+// occurred. The token t may be nil if the error isn't caused by a token.
+func (l *lexer) Error(t *token, kind ErrorKind, a ...interface{}) error {
+	e := &Error{
+		Kind: kind,
+		Name: l.name,
+		Line: l.line,
+		Col:  l.col,
+		Err:  errors.New(fmt.Sprint(a...)),
+	}
+	if t != nil {
+		e.Line, e.Col, e.Tag = t.line, t.col, l.tag(t)
+	}
+	return e
+}
+
+// report returns false if err should stop parsing. Otherwise the error is
+// added to errs and the parser recovers.
+func (l *lexer) report(err error) bool {
+	if !l.all {
+		return false
+	}
+	l.errs = append(l.errs, err)
+	return true
+}
+
+// tagChar returns the character after the left delimiter of a tag type, or 0
+// if tt isn't a tag.
+func tagChar(tt ttype) byte {
+	for c, t := range tagType {
+		if t == tt {
+			return c
+		}
+	}
+	return 0
+}
+
+// tag returns the source of a tag token with the current delimiters.
+func (l *lexer) tag(t *token) string {
+	if c := tagChar(t.tt); c != 0 {
+		return l.ldel + string(c) + t.val + l.rdel
+	}
+	return t.val
+}
+
+// advance moves the position past s.
+func (l *lexer) advance(s string) {
+	if i := strings.LastIndex(s, "\n"); i != -1 {
+		l.line += strings.Count(s, "\n")
+		l.col = len(s) - i
+		return
+	}
+	l.col += len(s)
 }
 
 // Next returns the next token or io.EOF.
@@ -77,19 +142,23 @@ func (l *lexer) Next() (*token, error) {
 		switch t.tt {
 		case ttChangeDelim:
 			tok := strings.Split(t.val, " ")
-			if len(tok) != 2 {
-				l.src = ""
-				return nil, l.Error("malformed tag")
-			}
-			if tok[0] == "" || tok[1] == "" {
-				l.src = ""
-				return nil, l.Error("malformed tag")
+			if len(tok) != 2 || tok[0] == "" || tok[1] == "" {
+				// Recover by keeping the delimiters.
+				if err := l.Error(t, ErrSyntax, "malformed tag"); !l.report(err) {
+					l.src = ""
+					return nil, err
+				}
+				continue
 			}
 			l.ldel = tok[0]
 			l.rdel = tok[1]
-			continue
+			if !l.keep {
+				continue
+			}
 		case ttComment:
-			continue
+			if !l.keep {
+				continue
+			}
 		}
 		return t, nil
 	}
@@ -100,7 +169,15 @@ func (l *lexer) next() (*token, error) {
 		return nil, nil
 	}
 	if strings.HasPrefix(l.src, l.ldel) {
-		return l.lexTag()
+		t, err := l.lexTag()
+		if err != nil && l.report(err) {
+			// Recover by lexing the left delimiter as a string.
+			t = &token{tt: ttString, val: l.ldel, line: l.line, col: l.col}
+			l.advance(l.ldel)
+			l.src = l.src[len(l.ldel):]
+			return t, nil
+		}
+		return t, err
 	}
 	return l.lexString()
 }
@@ -110,35 +187,32 @@ func (l *lexer) lexString() (*token, error) {
 	i := strings.Index(l.src, l.ldel)
 	if i == -1 {
 		// Remainder of source is string.
-		t := &token{tt: ttString, val: l.src, line: l.line}
-		l.src = ""
-		return t, nil
+		i = len(l.src)
 	}
-	t := &token{tt: ttString, val: l.src[:i], line: l.line}
+	t := &token{tt: ttString, val: l.src[:i], line: l.line, col: l.col}
 	l.src = l.src[i:]
-	l.line += strings.Count(t.val, "\n")
+	l.advance(t.val)
 	return t, nil
 }
 
 // lexTag is called when the src starts with a tag.
 func (l *lexer) lexTag() (*token, error) {
-	l.src = l.src[len(l.ldel):]
-	if len(l.src) < 1 {
-		return nil, l.Error("incomplete tag")
+	if len(l.src) == len(l.ldel) {
+		return nil, l.Error(nil, ErrSyntax, "incomplete tag")
 	}
-	tt, ok := tagType[l.src[0]]
+	tt, ok := tagType[l.src[len(l.ldel)]]
 	if !ok {
-		return nil, l.Error("unrecognized tag")
+		return nil, l.Error(nil, ErrSyntax, "unrecognized tag ", l.src[:len(l.ldel)+1])
 	}
-	l.src = l.src[1:]
-	i := strings.Index(l.src, l.rdel)
+	i := strings.Index(l.src[len(l.ldel)+1:], l.rdel)
 	if i == -1 {
-		return nil, l.Error("incomplete tag")
+		return nil, l.Error(nil, ErrSyntax, "incomplete tag")
 	}
-	t := &token{tt: tt, val: l.src[:i], line: l.line}
-	l.src = l.src[i+len(l.rdel):]
+	end := len(l.ldel) + 1 + i + len(l.rdel)
+	t := &token{tt: tt, val: l.src[len(l.ldel)+1 : end-len(l.rdel)], line: l.line, col: l.col}
 	// A tag name may have a newline in it.
-	l.line += strings.Count(t.val, "\n")
+	l.advance(l.src[:end])
+	l.src = l.src[end:]
 	return t, nil
 }
 
@@ -150,6 +224,7 @@ func newLexer(name, src string) *lexer {
 		rdel: rdel,
 		src:  src,
 		line: 1,
+		col:  1,
 	}
 }
 
@@ -168,8 +243,16 @@ func (l ttype) String() string {
 		return "array"
 	case ttComment:
 		return "comment"
+	case ttDirective:
+		return "directive"
+	case ttEach:
+		return "each"
+	case ttElse:
+		return "else"
 	case ttEnd:
 		return "end"
+	case ttIf:
+		return "if"
 	case ttIfdef:
 		return "ifdef"
 	case ttIfndef:
@@ -180,6 +263,8 @@ func (l ttype) String() string {
 		return "object"
 	case ttPrint:
 		return "print"
+	case ttRaw:
+		return "raw"
 	case ttString:
 		return "string"
 	}
@@ -15,16 +15,19 @@ func TestChangeDelim(t *testing.T) {
 			tt:   ttPrint,
 			val:  "a",
 			line: 1,
+			col:  1,
 		},
 		&token{
 			tt:   ttPrint,
 			val:  "b",
 			line: 1,
+			col:  17,
 		},
 		&token{
 			tt:   ttPrint,
 			val:  "c",
 			line: 1,
+			col:  33,
 		},
 	}
 	lex := newLexer("", src)
@@ -40,82 +43,103 @@ func TestChangeDelim(t *testing.T) {
 }	
 
 func TestLex(t *testing.T) {
-	src := "{{#a}}\n{{/c}}\n{{+d}}\n{{-e}}\n{{$f}}\n{{*g}}\n{{>h}}\n{{>i\n}}"
+	src := "{{#a}}\n{{/c}}\n{{+d}}\n{{-e}}\n{{$f}}\n{{*g}}\n{{>h}}\n{{>i\n}}{{:else}}"
 	tests := []*token{
 		&token{
 			tt:   ttArray,
 			val:  "a",
 			line: 1,
+			col:  1,
 		},
 		&token{
 			tt:   ttString,
 			val:  "\n",
 			line: 1,
+			col:  7,
 		},
 		&token{
 			tt:   ttEnd,
 			val:  "c",
 			line: 2,
+			col:  1,
 		},
 		&token{
 			tt:   ttString,
 			val:  "\n",
 			line: 2,
+			col:  7,
 		},
 		&token{
 			tt:   ttIfdef,
 			val:  "d",
 			line: 3,
+			col:  1,
 		},
 		&token{
 			tt:   ttString,
 			val:  "\n",
 			line: 3,
+			col:  7,
 		},
 		&token{
 			tt:   ttIfndef,
 			val:  "e",
 			line: 4,
+			col:  1,
 		},
 		&token{
 			tt:   ttString,
 			val:  "\n",
 			line: 4,
+			col:  7,
 		},
 		&token{
 			tt:   ttObject,
 			val:  "f",
 			line: 5,
+			col:  1,
 		},
 		&token{
 			tt:   ttString,
 			val:  "\n",
 			line: 5,
+			col:  7,
 		},
 		&token{
 			tt:   ttPrint,
 			val:  "g",
 			line: 6,
+			col:  1,
 		},
 		&token{
 			tt:   ttString,
 			val:  "\n",
 			line: 6,
+			col:  7,
 		},
 		&token{
 			tt:   ttInclude,
 			val:  "h",
 			line: 7,
+			col:  1,
 		},
 		&token{
 			tt:   ttString,
 			val:  "\n",
 			line: 7,
+			col:  7,
 		},
 		&token{
 			tt:   ttInclude,
 			val:  "i\n",
 			line: 8,
+			col:  1,
+		},
+		&token{
+			tt:   ttElse,
+			val:  "else",
+			line: 9,
+			col:  3,
 		},
 	}
 	lex := newLexer("", src)
@@ -0,0 +1,579 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"fmt"
+	"io/fs"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LintOptions control the checks done by Lint.
+type LintOptions struct {
+	// Partials are patterns, like the patterns of ParseFS, of the templates
+	// that are only meant to be included. An ErrUnused error is returned for a
+	// partial that no template includes. Templates defined with define are
+	// always partials.
+	Partials []string
+
+	// Data is sample data, for example decoded from JSON. If it isn't nil an
+	// ErrMissing error is returned for symbols that aren't in it.
+	Data interface{}
+
+	// Schema is a JSON Schema decoded from JSON. If it isn't nil an ErrMissing
+	// error is returned for symbols the schema doesn't have. Only the
+	// properties, additionalProperties, items, allOf, anyOf, oneOf and type
+	// keywords are used. Properties that aren't listed are missing unless
+	// additionalProperties is true or a schema.
+	Schema interface{}
+}
+
+// Lint parses every file in fsys that matches one of the patterns, like
+// ParseFS, and returns every problem it finds:
+//   - Syntax errors. All of them, not just the first one in a template.
+//   - Includes and extends of templates that don't exist, ErrNotFound.
+//   - Include cycles, ErrCycle.
+//   - Partials that aren't included, ErrUnused.
+//   - Symbols that aren't in the sample data or schema, ErrMissing.
+//
+// Symbols are only checked where they would cause an error when executing
+// with MissingError. Templates which aren't included by another template are
+// checked with the data, included templates are checked in the scope they're
+// included in. The Name of every *Error is the name of the file and the list
+// is sorted by file and position.
+func Lint(fsys fs.FS, patterns []string, opts LintOptions) ErrorList {
+	names, err := walk(fsys, patterns)
+	if err != nil {
+		return ErrorList{err}
+	}
+	sort.Strings(names)
+	ln := &linter{
+		set:     NewSet(),
+		tmpls:   make(map[string]*Template),
+		files:   make(map[string]string),
+		defines: make(map[string]pos),
+		seen:    make(map[string]bool),
+	}
+	for _, name := range names {
+		ln.parse(fsys, name)
+	}
+	ln.checkIncludes(opts.Partials)
+	ln.checkCycles()
+	if opts.Data != nil {
+		ln.checkSymbols(dataShape(reflect.ValueOf(opts.Data)), "sample data")
+	}
+	if opts.Schema != nil {
+		ln.checkSymbols(schemaShape(opts.Schema), "schema")
+	}
+	sort.SliceStable(ln.errs, func(i, j int) bool {
+		a, aok := ln.errs[i].(*Error)
+		b, bok := ln.errs[j].(*Error)
+		if !aok || !bok {
+			return !aok && bok
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return ln.errs
+}
+
+// linter holds the templates being linted and the problems found.
+type linter struct {
+	set     *Set                 // set has the templates without syntax errors.
+	tmpls   map[string]*Template // tmpls has every template.
+	files   map[string]string    // files maps template names to file names.
+	defines map[string]pos       // defines are the positions of define tags.
+	seen    map[string]bool      // seen stops reporting the same error twice.
+	errs    ErrorList
+}
+
+// error adds a problem found in the named template.
+func (ln *linter) error(kind ErrorKind, name string, p pos, err error) {
+	ln.errorIn(ln.files[name], kind, p, err)
+}
+
+// errorIn adds a problem found in the file.
+func (ln *linter) errorIn(file string, kind ErrorKind, p pos, err error) {
+	e := &Error{Kind: kind, Name: file, Line: p.line, Col: p.col, Tag: p.tag, Err: err}
+	if s := e.Error(); !ln.seen[s] {
+		ln.seen[s] = true
+		ln.errs = append(ln.errs, e)
+	}
+}
+
+// parse parses a file and adds its templates. Templates in a file with syntax
+// errors aren't added to the set but the tags that could be parsed are still
+// checked.
+func (ln *linter) parse(fsys fs.FS, file string) {
+	b, err := fs.ReadFile(fsys, file)
+	if err != nil {
+		ln.errs = append(ln.errs, err)
+		return
+	}
+	tree, errs := parseAll(RelName(file), string(b))
+	for _, err := range errs {
+		if e, ok := err.(*Error); ok {
+			e.Name = file
+		}
+	}
+	ln.errs = append(ln.errs, errs...)
+	t := &Template{name: RelName(file)}
+	var defines []*nodeDefine
+	for _, n := range tree {
+		if nt, ok := n.(*nodeDefine); ok {
+			defines = append(defines, nt)
+			continue
+		}
+		t.tree = append(t.tree, n)
+	}
+	ln.add(file, t, pos{}, errs != nil)
+	for _, nt := range defines {
+		if ln.add(file, &Template{name: nt.name, tree: nt.nodes}, nt.pos, errs != nil) {
+			ln.defines[nt.name] = nt.pos
+		}
+	}
+}
+
+// add adds a template from the file at p. It returns false if a template with
+// the same name was already added.
+func (ln *linter) add(file string, t *Template, p pos, broken bool) bool {
+	if other, ok := ln.files[t.name]; ok {
+		ln.errorIn(file, ErrSyntax, p, fmt.Errorf("template %q is also in %v", t.name, other))
+		return false
+	}
+	ln.files[t.name] = file
+	ln.tmpls[t.name] = t
+	if !broken {
+		ln.set.cache[t.name] = t
+	}
+	return true
+}
+
+// used returns the names of the templates that are included or extended by
+// another template.
+func (ln *linter) used() map[string]bool {
+	used := make(map[string]bool)
+	for name, t := range ln.tmpls {
+		inspect(t.tree, func(n node) {
+			switch nt := n.(type) {
+			case *nodeExtends:
+				if nt.name != name {
+					used[nt.name] = true
+				}
+			case *nodeInclude:
+				if nt.name != name {
+					used[nt.name] = true
+				}
+			}
+		})
+	}
+	return used
+}
+
+// checkIncludes reports includes of templates that don't exist and partials
+// that aren't included.
+func (ln *linter) checkIncludes(partials []string) {
+	for name, t := range ln.tmpls {
+		inspect(t.tree, func(n node) {
+			var p pos
+			var target string
+			switch nt := n.(type) {
+			case *nodeExtends:
+				p, target = nt.pos, nt.name
+			case *nodeInclude:
+				p, target = nt.pos, nt.name
+			default:
+				return
+			}
+			if _, ok := ln.tmpls[target]; !ok {
+				ln.error(ErrNotFound, name, p, fmt.Errorf("template %q not found", target))
+			}
+		})
+	}
+	used := ln.used()
+	for name := range ln.tmpls {
+		if used[name] {
+			continue
+		}
+		if p, ok := ln.defines[name]; ok {
+			ln.error(ErrUnused, name, p, fmt.Errorf("template %q is never included", name))
+		} else if len(partials) > 0 && match(ln.files[name], partials) {
+			ln.error(ErrUnused, name, pos{}, fmt.Errorf("template %q is never included", name))
+		}
+	}
+}
+
+// checkCycles reports every include cycle once.
+func (ln *linter) checkCycles() {
+	var names []string
+	for name := range ln.set.cache {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	reported := make(map[string]bool)
+	for _, name := range names {
+		if reported[name] {
+			continue
+		}
+		n, path := ln.set.findCycle(ln.set.cache[name])
+		if n == nil {
+			continue
+		}
+		for _, p := range path {
+			reported[p] = true
+		}
+		ln.error(ErrCycle, name, n.pos, fmt.Errorf("include cycle %v -> %v", name, strings.Join(path, " -> ")))
+	}
+}
+
+// checkSymbols checks the symbols of every template that isn't included by
+// another template against the shape of the data.
+func (ln *linter) checkSymbols(root *shape, source string) {
+	used := ln.used()
+	var names []string
+	for name := range ln.tmpls {
+		if !used[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := &symbolChecker{ln: ln, source: source, active: make(map[string]bool)}
+		c.template(ln.tmpls[name], []*shape{root})
+	}
+}
+
+// symbolChecker walks the templates like they're executed, keeping track of
+// the shape of the data in every scope.
+type symbolChecker struct {
+	ln     *linter
+	source string          // source is what the data is called in errors.
+	active map[string]bool // active are the templates being checked.
+}
+
+// template checks a template, or the root of the layouts it extends with its
+// blocks.
+func (c *symbolChecker) template(t *Template, scopes []*shape) {
+	if c.active[t.name] {
+		return
+	}
+	c.active[t.name] = true
+	defer delete(c.active, t.name)
+	root := t
+	blocks := make(map[string]block)
+	seen := map[string]bool{t.name: true}
+	for ext := extends(root.tree); ext != nil; ext = extends(root.tree) {
+		collectBlocks(root, root.tree, blocks)
+		parent := c.ln.tmpls[ext.name]
+		if parent == nil || seen[parent.name] {
+			return
+		}
+		seen[parent.name] = true
+		root = parent
+	}
+	c.nodes(root.name, root.tree, scopes, blocks)
+}
+
+// nodes checks the symbols of the nodes of the named template.
+func (c *symbolChecker) nodes(name string, tree []node, scopes []*shape, blocks map[string]block) {
+	for _, n := range tree {
+		switch nt := n.(type) {
+		case *nodeBlock:
+			if b, ok := blocks[nt.name]; ok {
+				c.nodes(b.tmpl.name, b.n.nodes, scopes, blocks)
+			} else {
+				c.nodes(name, nt.nodes, scopes, blocks)
+			}
+		case *nodeInclude:
+			t := c.ln.tmpls[nt.name]
+			if t == nil {
+				continue
+			}
+			inner := scopes
+			if nt.scope != nil {
+				if s := c.expr(nt.scope, scopes); s.object() {
+					inner = push(inner, s)
+				}
+			}
+			if nt.args != nil {
+				args := &shape{fields: make(map[string]*shape)}
+				for _, a := range nt.args {
+					args.fields[a.name] = c.expr(a.val, scopes)
+				}
+				inner = push(inner, args)
+			}
+			c.template(t, inner)
+		case *nodePrint:
+			if !nt.hasDefault() {
+				c.lookup(name, nt.pos, nt.name, scopes)
+			}
+		case *nodeArray:
+			s := c.section(name, nt.pos, nt.name, nt.alt, scopes)
+			elem := anyShape
+			if s != nil && s.elem != nil {
+				elem = s.elem
+			}
+			inner := scopes
+			if elem.object() {
+				inner = push(inner, elem)
+			}
+			c.nodes(name, nt.nodes, inner, blocks)
+			c.nodes(name, nt.alt, scopes, blocks)
+		case *nodeEach:
+			s := c.section(name, nt.pos, nt.name, nt.alt, scopes)
+			val := anyShape
+			if s != nil && s.values != nil {
+				val = s.values
+			} else if s != nil && !s.any {
+				val = nil
+				for _, f := range s.fields {
+					val = merge(val, f)
+				}
+			}
+			inner := scopes
+			if val != nil && val.object() {
+				inner = push(inner, val)
+			}
+			c.nodes(name, nt.nodes, inner, blocks)
+			c.nodes(name, nt.alt, scopes, blocks)
+		case *nodeObject:
+			s := c.section(name, nt.pos, nt.name, nt.alt, scopes)
+			if s == nil {
+				s = anyShape
+			}
+			c.nodes(name, nt.nodes, push(scopes, s), blocks)
+			c.nodes(name, nt.alt, scopes, blocks)
+		case *nodeIf:
+			c.nodes(name, nt.nodes, scopes, blocks)
+			c.nodes(name, nt.alt, scopes, blocks)
+		case *nodeIfdef:
+			c.nodes(name, nt.nodes, scopes, blocks)
+			c.nodes(name, nt.alt, scopes, blocks)
+		case *nodeIfndef:
+			c.nodes(name, nt.nodes, scopes, blocks)
+			c.nodes(name, nt.alt, scopes, blocks)
+		}
+	}
+}
+
+// section returns the shape of the symbol of a section, or nil if it isn't
+// defined. Like MissingError, a section with an else isn't an error.
+func (c *symbolChecker) section(name string, p pos, symbol string, alt []node, scopes []*shape) *shape {
+	if alt != nil {
+		s, _ := resolve(symbol, scopes)
+		return s
+	}
+	return c.lookup(name, p, symbol, scopes)
+}
+
+// lookup returns the shape of the symbol, or reports an error and returns nil
+// if it isn't defined.
+func (c *symbolChecker) lookup(name string, p pos, symbol string, scopes []*shape) *shape {
+	s, ok := resolve(symbol, scopes)
+	if !ok {
+		c.ln.error(ErrMissing, name, p, fmt.Errorf("%q not in %v", symbol, c.source))
+	}
+	return s
+}
+
+// expr returns the shape of an include scope or argument.
+func (c *symbolChecker) expr(x expr, scopes []*shape) *shape {
+	if p, ok := x.(*exprPath); ok {
+		if s, ok := resolve(p.name, scopes); ok && s != nil {
+			return s
+		}
+		return anyShape
+	}
+	return &shape{}
+}
+
+// shape is what is known about the data at a symbol.
+type shape struct {
+	any    bool              // any is true if nothing is known.
+	fields map[string]*shape // fields of an object.
+	values *shape            // values of the fields that aren't in fields.
+	elem   *shape            // elem of an array, merged from all elements.
+}
+
+// anyShape is data that isn't known.
+var anyShape = &shape{any: true}
+
+// object returns true if the shape can be entered as a scope.
+func (s *shape) object() bool {
+	return s.any || s.fields != nil || s.values != nil
+}
+
+// field returns the shape of a key, or nil if it isn't defined.
+func (s *shape) field(key string) *shape {
+	if s.any {
+		return anyShape
+	}
+	if f, ok := s.fields[key]; ok {
+		return f
+	}
+	if s.values != nil {
+		return s.values
+	}
+	if _, err := strconv.Atoi(key); err == nil && s.elem != nil {
+		return s.elem
+	}
+	return nil
+}
+
+// push returns the scopes with s as the inner most scope.
+func push(scopes []*shape, s *shape) []*shape {
+	return append(scopes[:len(scopes):len(scopes)], s)
+}
+
+// resolve returns the shape of a symbol looked up like symtab.lookup. It
+// returns false if the symbol isn't defined. Loop symbols and the array
+// element are always defined but their shape isn't known.
+func resolve(symbol string, scopes []*shape) (*shape, bool) {
+	if symbol == "" || strings.HasPrefix(symbol, "@") {
+		return nil, true
+	}
+	path, err := parsePath(symbol)
+	if err != nil {
+		return nil, false
+	}
+	var s *shape
+	for i := len(scopes) - 1; i >= 0 && s == nil; i-- {
+		s = scopes[i].field(path[0])
+	}
+	for _, key := range path[1:] {
+		if s == nil {
+			break
+		}
+		s = s.field(key)
+	}
+	return s, s != nil
+}
+
+// merge returns a shape with the fields of both shapes. Either may be nil.
+func merge(a, b *shape) *shape {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.any || b.any {
+		return anyShape
+	}
+	s := &shape{values: merge(a.values, b.values), elem: merge(a.elem, b.elem)}
+	if a.fields != nil || b.fields != nil {
+		s.fields = make(map[string]*shape)
+		for k, f := range a.fields {
+			s.fields[k] = f
+		}
+		for k, f := range b.fields {
+			s.fields[k] = merge(s.fields[k], f)
+		}
+	}
+	return s
+}
+
+// dataShape returns the shape of sample data. An empty array could hold
+// anything.
+func dataShape(v reflect.Value) *shape {
+	v = indirect(v)
+	switch {
+	case isObject(v):
+		s := &shape{fields: make(map[string]*shape)}
+		for _, key := range objectKeys(v) {
+			s.fields[key] = dataShape(field(v, key))
+		}
+		return s
+	case isArray(v):
+		s := &shape{}
+		for i := 0; i < v.Len(); i++ {
+			s.elem = merge(s.elem, dataShape(v.Index(i)))
+		}
+		if s.elem == nil {
+			s.elem = anyShape
+		}
+		return s
+	}
+	return &shape{}
+}
+
+// schemaShape returns the shape of a JSON Schema. Schemas that use keywords
+// which aren't supported could hold anything.
+func schemaShape(schema interface{}) *shape {
+	m, ok := schema.(map[string]interface{})
+	if !ok {
+		return anyShape
+	}
+	var s *shape
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		if subs, ok := m[key].([]interface{}); ok {
+			for _, sub := range subs {
+				s = merge(s, schemaShape(sub))
+			}
+		}
+	}
+	known := false
+	own := &shape{}
+	if props, ok := m["properties"].(map[string]interface{}); ok {
+		known = true
+		own.fields = make(map[string]*shape)
+		for key, sub := range props {
+			own.fields[key] = schemaShape(sub)
+		}
+	}
+	switch ap := m["additionalProperties"].(type) {
+	case bool:
+		known = true
+		if ap {
+			own.values = anyShape
+		} else if own.fields == nil {
+			own.fields = make(map[string]*shape)
+		}
+	case map[string]interface{}:
+		known = true
+		own.values = schemaShape(ap)
+	}
+	switch items := m["items"].(type) {
+	case map[string]interface{}:
+		known = true
+		own.elem = schemaShape(items)
+	case []interface{}:
+		known = true
+		for _, sub := range items {
+			own.elem = merge(own.elem, schemaShape(sub))
+		}
+	}
+	if !known && s == nil && !scalarSchema(m["type"]) {
+		return anyShape
+	}
+	if !known && s != nil {
+		return s
+	}
+	return merge(s, own)
+}
+
+// scalarSchema returns true if the JSON Schema type can't have properties or
+// items.
+func scalarSchema(typ interface{}) bool {
+	types, ok := typ.([]interface{})
+	if !ok {
+		types = []interface{}{typ}
+	}
+	for _, t := range types {
+		switch t {
+		case "string", "number", "integer", "boolean", "null":
+		default:
+			return false
+		}
+	}
+	return true
+}
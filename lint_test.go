@@ -0,0 +1,166 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// lintFS has a problem of every kind.
+var lintFS = fstest.MapFS{
+	"page.tmpl":         {Data: []byte("{{%extends layouts/base}}{{%block content}}{{#items}}{{>card}}\n{{*pirce}}{{/items}}{{>nope}}{{/content}}")},
+	"layouts/base.tmpl": {Data: []byte("<title>{{*title}}</title>{{%block content}}{{/content}}{{*footer|default \"x\"}}")},
+	"card.tmpl":         {Data: []byte("{{*name}}{{*titel}}{{%define unused}}x{{/unused}}")},
+	"partials/old.tmpl": {Data: []byte("old")},
+	"a.tmpl":            {Data: []byte("{{>b}}")},
+	"b.tmpl":            {Data: []byte("{{>a}}")},
+	"bad.tmpl":          {Data: []byte("{{#x}}{{/y}}\n{{#z}}{{>gone}}")},
+	"user.tmpl":         {Data: []byte("{{$user}}{{*name}}{{*emial}}{{/user}}{{#tags}}{{*}}{{/tags}}{{#none}}{{:else}}-{{/none}}{{>card user}}{{>card name=user.email}}")},
+	"x.txt":             {Data: []byte("{{#")},
+}
+
+func TestLint(t *testing.T) {
+	var data, schema interface{}
+	if err := json.Unmarshal([]byte(`{"title": "t", "items": [{"name": "a", "price": 1}], "user": {"name": "u", "email": "e"}, "tags": ["x"]}`), &data); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {
+			"title": {"type": "string"},
+			"items": {"type": "array", "items": {"properties": {"name": {}, "price": {}}}},
+			"user": {"allOf": [{"properties": {"name": {"type": "string"}}}, {"properties": {"email": {}}}]},
+			"tags": {"type": "array", "items": {"type": "string"}}
+		}
+	}`), &schema); err != nil {
+		t.Fatal(err)
+	}
+	errs := Lint(lintFS, []string{"*.tmpl"}, LintOptions{Partials: []string{"partials/*"}, Data: data, Schema: schema})
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		`a.tmpl:1:1: include cycle a -> b -> a: {{>b}}`,
+		`bad.tmpl:1:1: "x" not in sample data: {{#x}}`,
+		`bad.tmpl:1:1: "x" not in schema: {{#x}}`,
+		`bad.tmpl:1:7: unmatched tag, expecting end of {{#x}}: {{/y}}`,
+		`bad.tmpl:2:1: unclosed scope: {{#z}}`,
+		`bad.tmpl:2:1: "z" not in sample data: {{#z}}`,
+		`bad.tmpl:2:1: "z" not in schema: {{#z}}`,
+		`bad.tmpl:2:7: template "gone" not found: {{>gone}}`,
+		`card.tmpl:1:10: "titel" not in sample data: {{*titel}}`,
+		`card.tmpl:1:10: "titel" not in schema: {{*titel}}`,
+		`card.tmpl:1:20: template "unused" is never included: {{%define unused}}`,
+		`page.tmpl:2:1: "pirce" not in sample data: {{*pirce}}`,
+		`page.tmpl:2:1: "pirce" not in schema: {{*pirce}}`,
+		`page.tmpl:2:21: template "nope" not found: {{>nope}}`,
+		`partials/old.tmpl: template "partials/old" is never included`,
+		`user.tmpl:1:19: "emial" not in sample data: {{*emial}}`,
+		`user.tmpl:1:19: "emial" not in schema: {{*emial}}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	kinds := []ErrorKind{ErrCycle, ErrMissing, ErrMissing, ErrUnmatched, ErrUnclosed, ErrMissing, ErrMissing, ErrNotFound, ErrMissing, ErrMissing, ErrUnused}
+	for i, kind := range kinds {
+		if e := errs[i].(*Error); e.Kind != kind {
+			t.Fatalf("test %q, got kind %v, want %v", e, e.Kind, kind)
+		}
+	}
+	if errs := Lint(lintFS, []string{"layouts/*"}, LintOptions{}); errs != nil {
+		t.Fatalf("got %v, want no errors", errs)
+	}
+}
+
+func TestLintSymbols(t *testing.T) {
+	tests := []struct {
+		src    string // src is the template.
+		data   string // data is sample data, or "" if there is a schema.
+		schema string // schema is a JSON Schema, or "".
+		want   string // want these errors separated by newlines.
+	}{
+		{
+			src:  "{{#items}}{{*name}}{{/items}}{{*a.0.b}}{{*a.1.c}}",
+			data: `{"items": [], "a": [{"b": 1}]}`,
+			want: `x.tmpl:1:40: "a.1.c" not in sample data: {{*a.1.c}}`,
+		},
+		{
+			src:  "{{*a.b.c}}{{?zz}}{{/?}}{{+zz}}{{/zz}}{{*zz|default 1}}{{#zz}}{{:else}}{{/zz}}{{*@index}}",
+			data: `{"a": {"b": 1}}`,
+			want: `x.tmpl:1:1: "a.b.c" not in sample data: {{*a.b.c}}`,
+		},
+		{
+			src:  "{{@m}}{{*@key}}{{*x}}{{*y}}{{/m}}{{$o}}{{*x}}{{*a}}{{/o}}",
+			data: `{"m": {"k": {"x": 1}, "l": {"y": 2}}, "o": {"x": 1}, "a": 1}`,
+		},
+		{
+			src:  "{{#zz}}{{*yy}}{{/zz}}{{$o}}{{*xx}}{{/o}}",
+			data: `{}`,
+			want: "x.tmpl:1:1: \"zz\" not in sample data: {{#zz}}\nx.tmpl:1:22: \"o\" not in sample data: {{$o}}",
+		},
+		{
+			src:  "{{*zz}}{{#a}}{{*yy}}{{/b}}",
+			data: `{"a": []}`,
+			want: "x.tmpl:1:1: \"zz\" not in sample data: {{*zz}}\nx.tmpl:1:21: unmatched tag, expecting end of {{#a}}: {{/b}}",
+		},
+		{
+			src:    "{{*anything.at.all}}",
+			schema: `{"type": "object"}`,
+		},
+		{
+			src:    "{{*a.b}}{{*c}}",
+			schema: `{"properties": {"a": {"type": "string"}}, "additionalProperties": true}`,
+			want:   `x.tmpl:1:1: "a.b" not in schema: {{*a.b}}`,
+		},
+		{
+			src:    "{{@m}}{{*x}}{{*y}}{{/m}}{{*m.k.x}}",
+			schema: `{"properties": {"m": {"additionalProperties": {"properties": {"x": {}}}}}}`,
+			want:   "x.tmpl:1:13: \"y\" not in schema: {{*y}}",
+		},
+		{
+			src:    "{{#a}}{{*b}}{{*c}}{{/a}}",
+			schema: `{"properties": {"a": {"items": [{"properties": {"b": {}}}, {"properties": {"c": {}}}]}}, "additionalProperties": false}`,
+		},
+	}
+	for _, test := range tests {
+		fsys := fstest.MapFS{"x.tmpl": {Data: []byte(test.src)}}
+		var opts LintOptions
+		if test.data != "" {
+			if err := json.Unmarshal([]byte(test.data), &opts.Data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.schema != "" {
+			if err := json.Unmarshal([]byte(test.schema), &opts.Schema); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := ""
+		if errs := Lint(fsys, nil, opts); errs != nil {
+			got = errs.Error()
+		}
+		if got != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.src, got, test.want)
+		}
+	}
+}
+
+func TestLintStruct(t *testing.T) {
+	type item struct {
+		Name string `json:"name"`
+	}
+	data := struct {
+		Items []item
+		Title string `json:"title"`
+	}{Items: []item{{Name: "a"}}}
+	fsys := fstest.MapFS{"x.tmpl": {Data: []byte("{{*title}}{{#Items}}{{*name}}{{*Name}}{{/Items}}")}}
+	errs := Lint(fsys, nil, LintOptions{Data: data})
+	if got, want := errs.Error(), `x.tmpl:1:30: "Name" not in sample data: {{*Name}}`; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
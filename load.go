@@ -0,0 +1,156 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrorList is returned when loading many templates. Every template that
+// couldn't be parsed or added has an error in the list.
+type ErrorList []error
+
+// Error returns every error on a separate line.
+func (l ErrorList) Error() string {
+	s := make([]string, len(l))
+	for i, err := range l {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// RelName returns the name of a template loaded from a directory. The name is
+// the slash separated path relative to the directory without the extension,
+// so "emails/header.tmpl" is included with "{{>emails/header}}".
+func RelName(rel string) string {
+	rel = filepath.ToSlash(rel)
+	return strings.TrimSuffix(rel, path.Ext(rel))
+}
+
+// match returns true if the file matches one of the patterns. A pattern without
+// a "/" is matched against the base name, otherwise it is matched against the
+// path. Every file matches if there are no patterns.
+func match(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		target := name
+		if !strings.Contains(p, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFS parses every file in fsys that matches one of the patterns and adds
+// them to the set. A pattern such as "*.tmpl" is matched against the base name
+// of the file and a pattern such as "emails/*.tmpl" is matched against the
+// path. If there are no patterns every file is parsed. Templates are named
+// with RelName and passed to the OnLoad function. If any template couldn't be
+// parsed or added an ErrorList is returned and the rest of the templates are
+// still added.
+func (s *Set) ParseFS(fsys fs.FS, patterns ...string) error {
+	names, err := walk(fsys, patterns)
+	if err != nil {
+		return err
+	}
+	return s.parseFiles(fsys, names)
+}
+
+// walk returns the files in fsys that match one of the patterns.
+func walk(fsys fs.FS, patterns []string) ([]string, error) {
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && match(name, patterns) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// ParseDir parses every file in the directory tree that matches one of the
+// patterns. See ParseFS.
+func (s *Set) ParseDir(dir string, patterns ...string) error {
+	return s.ParseFS(os.DirFS(dir), patterns...)
+}
+
+// ParseGlob parses the files that match the pattern, for example
+// "templates/*/*.tmpl". The templates are named by their path relative to the
+// directory before the first wildcard, so "templates/emails/header.tmpl" is
+// named "emails/header". It's an error if no files match.
+func (s *Set) ParseGlob(pattern string) error {
+	filenames, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(filenames) == 0 {
+		return fmt.Errorf("pattern %q matches no files", pattern)
+	}
+	dir := globDir(pattern)
+	names := make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		rel, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+	}
+	return s.parseFiles(os.DirFS(dir), names)
+}
+
+// globDir returns the directory of the pattern before the first wildcard.
+func globDir(pattern string) string {
+	i := strings.IndexAny(pattern, `*?[\`)
+	if i == -1 {
+		return filepath.Dir(pattern)
+	}
+	return filepath.Dir(pattern[:i] + "x")
+}
+
+// parseFiles parses the files in fsys and adds them to the set in sorted
+// order.
+func (s *Set) parseFiles(fsys fs.FS, names []string) error {
+	sort.Strings(names)
+	var errs ErrorList
+	var tmpls []*Template
+	for _, name := range names {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		t, err := parseNamed(RelName(name), string(b))
+		if err == nil {
+			err = s.loaded(t)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tmpls = append(tmpls, t)
+	}
+	for _, t := range tmpls {
+		if err := s.Add(t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
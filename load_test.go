@@ -0,0 +1,160 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+var relNameTests = []struct {
+	rel  string
+	want string
+}{
+	{"a.tmpl", "a"},
+	{"emails/header.tmpl", "emails/header"},
+	{"a.b.tmpl", "a.b"},
+	{"a", "a"},
+}
+
+func TestRelName(t *testing.T) {
+	for _, test := range relNameTests {
+		if got := RelName(test.rel); got != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.rel, got, test.want)
+		}
+	}
+}
+
+var matchTests = []struct {
+	name     string
+	patterns []string
+	want     bool
+}{
+	{"a.tmpl", nil, true},
+	{"a.tmpl", []string{"*.tmpl"}, true},
+	{"emails/a.tmpl", []string{"*.tmpl"}, true},
+	{"emails/a.tmpl", []string{"pages/*.tmpl"}, false},
+	{"emails/a.tmpl", []string{"pages/*.tmpl", "emails/*"}, true},
+	{"a.txt", []string{"*.tmpl"}, false},
+}
+
+func TestMatch(t *testing.T) {
+	for _, test := range matchTests {
+		if got := match(test.name, test.patterns); got != test.want {
+			t.Fatalf("test %q %q, got %v, want %v", test.name, test.patterns, got, test.want)
+		}
+	}
+}
+
+// executeSet executes the template in the set with "name" set to "foo".
+func executeSet(t *testing.T, set *Set, name string) string {
+	got := bytes.NewBuffer(nil)
+	if err := set.Execute(got, name, map[string]interface{}{"name": "foo"}); err != nil {
+		t.Fatalf("couldn't execute %q: %v", name, err)
+	}
+	return got.String()
+}
+
+func TestParseDir(t *testing.T) {
+	set := NewSet()
+	if err := set.ParseDir("testdata/dir", "*.tmpl"); err != nil {
+		t.Fatalf("couldn't parse dir: %v", err)
+	}
+	if got, want := executeSet(t, set, "pages/index"), "Hello foo\nbody"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if set.template("README") != nil {
+		t.Fatal("file that doesn't match pattern added")
+	}
+}
+
+func TestParseGlob(t *testing.T) {
+	set := NewSet()
+	if err := set.ParseGlob(filepath.Join("testdata", "dir", "*", "*.tmpl")); err != nil {
+		t.Fatalf("couldn't parse glob: %v", err)
+	}
+	if got, want := executeSet(t, set, "pages/index"), "Hello foo\nbody"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	pattern := filepath.Join("testdata", "dir", "*.none")
+	if err := set.ParseGlob(pattern); err == nil || err.Error() != fmt.Sprintf("pattern %q matches no files", pattern) {
+		t.Fatalf("got error %v, want no files", err)
+	}
+}
+
+func TestParseFSErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.tmpl":   {Data: []byte("{{#a}}")},
+		"b/c.tmpl": {Data: []byte("x\n{{/c}}")},
+		"d.tmpl":   {Data: []byte("{{>e}}")},
+		"e.tmpl":   {Data: []byte("{{>d}}")},
+		"f.tmpl":   {Data: []byte("{{*name}}")},
+	}
+	set := NewSet()
+	err := set.ParseFS(fsys)
+	var errs ErrorList
+	if !errors.As(err, &errs) {
+		t.Fatalf("got error %v, want ErrorList", err)
+	}
+	want := []struct {
+		kind ErrorKind
+		name string
+	}{
+		{ErrUnclosed, "a"},
+		{ErrUnopened, "b/c"},
+		{ErrCycle, "e"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %v errors, want %v: %v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		var e *Error
+		if !errors.As(errs[i], &e) || e.Kind != w.kind || e.Name != w.name {
+			t.Fatalf("error %v, got %v, want %v in %q", i, errs[i], w.kind, w.name)
+		}
+	}
+	if got, want := executeSet(t, set, "f"), "foo"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseFSOnLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.tmpl":   {Data: []byte("<a href=\"{{>link}}\">\n  {{*name}}</a>")},
+		"link.tmpl":   {Data: []byte("{{*url}}")},
+		"layout.tmpl": {Data: []byte("{{%define inner}}<b>{{*name}}</b>{{/inner}}")},
+	}
+	set := NewSet()
+	var loaded []string
+	set.OnLoad(func(t *Template) error {
+		loaded = append(loaded, t.name)
+		t.Filter(TrimLeftSpace)
+		return t.AutoEscape()
+	})
+	if err := set.ParseFS(fsys); err != nil {
+		t.Fatalf("couldn't parse: %v", err)
+	}
+	if got, want := fmt.Sprint(loaded), "[layout link page]"; got != want {
+		t.Fatalf("got loaded %v, want %v", got, want)
+	}
+	got := bytes.NewBuffer(nil)
+	data := map[string]interface{}{"name": "<x>", "url": "javascript:x"}
+	if err := set.Execute(got, "page", data); err != nil {
+		t.Fatalf("couldn't execute: %v", err)
+	}
+	if got, want := got.String(), "<a href=\"#ZstemZ\">\n&lt;x&gt;</a>"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	got.Reset()
+	if err := set.Execute(got, "inner", data); err != nil {
+		t.Fatalf("couldn't execute: %v", err)
+	}
+	if got, want := got.String(), "<b>&lt;x&gt;</b>"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+// DefaultMaxDepth is used when ExecuteOptions.MaxDepth is zero.
+const DefaultMaxDepth = 1000
+
+// MissingKey controls what happens when a symbol or include isn't defined.
+type MissingKey int
+
+const (
+	// MissingZero prints nothing for print tags and includes, and doesn't
+	// render sections.
+	MissingZero MissingKey = iota
+
+	// MissingError stops execution with an ErrMissing error. A section with an
+	// else, a print tag with a default formatter and the ifdef, ifndef and
+	// condition tags never cause an error.
+	MissingError
+
+	// MissingKeep is like MissingZero except print tags and includes output
+	// the tag unchanged.
+	MissingKeep
+)
+
+// ExecuteOptions control how a template is executed.
+type ExecuteOptions struct {
+	// MaxDepth is the max number of nested sections and includes. Recursive
+	// includes stop with an ErrDepth error when it's exceeded.
+	MaxDepth int
+
+	// MissingKey controls what happens when a symbol or include isn't defined.
+	MissingKey MissingKey
+
+	// The limits below are meant for templates that aren't trusted. Zero means
+	// no limit.
+
+	// MaxOutputBytes is the max number of bytes written. Output that would
+	// exceed it isn't written and an ErrOutputLimit error is returned.
+	MaxOutputBytes int64
+
+	// MaxNodes is the max number of tags and strings evaluated. An ErrNodeLimit
+	// error is returned when it's exceeded.
+	MaxNodes int
+
+	// MaxIterations is the max total number of times array and object sections
+	// repeat. An ErrIterationLimit error is returned when it's exceeded.
+	MaxIterations int
+
+	// MaxIncludeDepth is the max number of nested includes. An
+	// ErrIncludeDepth error is returned when it's exceeded.
+	MaxIncludeDepth int
+}
+
+// maxDepth returns the max depth or the default if it isn't set.
+func (o *ExecuteOptions) maxDepth() int {
+	if o.MaxDepth <= 0 {
+		return DefaultMaxDepth
+	}
+	return o.MaxDepth
+}
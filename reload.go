@@ -0,0 +1,205 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"crypto/sha256"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is how often a Reloader polls when Interval is zero.
+const DefaultInterval = time.Second
+
+// Reloader keeps the templates in a Set up to date with the files in a
+// directory tree. It is meant for development so templates can be edited
+// without restarting the program.
+type Reloader struct {
+	// Interval between polls. DefaultInterval is used if it is zero.
+	Interval time.Duration
+
+	// OnError is called by the polling goroutine with every error. A template
+	// that fails to parse keeps the last good version in the Set.
+	OnError func(error)
+
+	set      *Set
+	fsys     fs.FS
+	patterns []string
+
+	mu    sync.Mutex           // mu protects files and serializes reloads.
+	files map[string]fileState // files by path in fsys.
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// fileState is what a file looked like when it was last parsed.
+type fileState struct {
+	mod   time.Time
+	size  int64
+	sum   [sha256.Size]byte
+	names []string // names of the templates in the file.
+}
+
+// NewReloader returns a Reloader that adds the files in fsys that match one of
+// the patterns to the set. Patterns, template names and the OnLoad function
+// are the same as Set.ParseFS.
+func NewReloader(set *Set, fsys fs.FS, patterns ...string) *Reloader {
+	return &Reloader{
+		set:      set,
+		fsys:     fsys,
+		patterns: patterns,
+		files:    make(map[string]fileState),
+	}
+}
+
+// NewDirReloader returns a Reloader for the directory tree. See NewReloader.
+func NewDirReloader(set *Set, dir string, patterns ...string) *Reloader {
+	return NewReloader(set, os.DirFS(dir), patterns...)
+}
+
+// Reload parses the files that changed since the last reload and swaps them
+// into the Set at once. A file is reparsed when its modification time or size
+// changed and the contents hash differs. Templates for deleted files are
+// removed from the Set. If any template couldn't be parsed or added an
+// ErrorList is returned and the last good version is kept. A template that
+// couldn't be added because of an include cycle is tried again on the next
+// reload.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names, err := walk(r.fsys, r.patterns)
+	if err != nil {
+		return err
+	}
+	var errs ErrorList
+	var add []replacement
+	var files []string // files[i] is the file of add[i].
+	var states []fileState
+	var del []string
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+		info, err := fs.Stat(r.fsys, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		old, ok := r.files[name]
+		if ok && old.mod.Equal(info.ModTime()) && old.size == info.Size() {
+			continue
+		}
+		b, err := fs.ReadFile(r.fsys, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		st := fileState{mod: info.ModTime(), size: info.Size(), sum: sha256.Sum256(b), names: old.names}
+		if ok && old.sum == st.sum {
+			r.files[name] = st
+			continue
+		}
+		t, err := parseNamed(RelName(name), string(b))
+		if err == nil {
+			err = r.set.loaded(t)
+		}
+		if err != nil {
+			// The file isn't parsed again until it changes.
+			r.files[name] = st
+			errs = append(errs, err)
+			continue
+		}
+		st.names = []string{t.name}
+		for _, d := range t.defines {
+			st.names = append(st.names, d.name)
+		}
+		// Remove templates that are no longer defined in the file.
+		add = append(add, replacement{t: t, stale: removed(old.names, st.names)})
+		files = append(files, name)
+		states = append(states, st)
+	}
+	for name, st := range r.files {
+		if !seen[name] {
+			delete(r.files, name)
+			del = append(del, st.names...)
+		}
+	}
+	for i, err := range r.set.swap(add, del) {
+		if err != nil {
+			// The file state isn't recorded so the file is retried on the
+			// next reload, the include cycle may be broken by another file.
+			errs = append(errs, err)
+			continue
+		}
+		r.files[files[i]] = states[i]
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// Start reloads in a new goroutine every Interval until Stop is called.
+func (r *Reloader) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+			err := r.Reload()
+			if err == nil || r.OnError == nil {
+				continue
+			}
+			if errs, ok := err.(ErrorList); ok {
+				for _, err := range errs {
+					r.OnError(err)
+				}
+			} else {
+				r.OnError(err)
+			}
+		}
+	}()
+}
+
+// Stop the goroutine started by Start and wait for it to exit. Stop does
+// nothing if the goroutine isn't running.
+func (r *Reloader) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
+
+// removed returns the names in old that aren't in names.
+func removed(old, names []string) []string {
+	var del []string
+	for _, o := range old {
+		found := false
+		for _, n := range names {
+			if n == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			del = append(del, o)
+		}
+	}
+	return del
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	mod := time.Unix(0, 0)
+	fsys := fstest.MapFS{
+		"a.tmpl": {Data: []byte("{{*name}}"), ModTime: mod},
+		"b.tmpl": {Data: []byte("b"), ModTime: mod},
+	}
+	set := NewSet()
+	r := NewReloader(set, fsys, "*.tmpl")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("couldn't reload: %v", err)
+	}
+	if got, want := executeSet(t, set, "a"), "foo"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// A template that fails to parse keeps the last good version.
+	mod = mod.Add(time.Second)
+	fsys["a.tmpl"] = &fstest.MapFile{Data: []byte("{{#name}}"), ModTime: mod}
+	err := r.Reload()
+	var errs ErrorList
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("got error %v, want one error", err)
+	}
+	if got, want := executeSet(t, set, "a"), "foo"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Unchanged files aren't parsed again so the error isn't repeated.
+	if err := r.Reload(); err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+
+	// Touching a file without changing it doesn't replace the template.
+	mod = mod.Add(time.Second)
+	fsys["b.tmpl"] = &fstest.MapFile{Data: []byte("b"), ModTime: mod}
+	before := set.template("b")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("couldn't reload: %v", err)
+	}
+	if set.template("b") != before {
+		t.Fatal("unchanged template replaced")
+	}
+
+	mod = mod.Add(time.Second)
+	fsys["a.tmpl"] = &fstest.MapFile{Data: []byte("{{*name}}{{>b}}"), ModTime: mod}
+	delete(fsys, "b.tmpl")
+	fsys["c.tmpl"] = &fstest.MapFile{Data: []byte("c"), ModTime: mod}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("couldn't reload: %v", err)
+	}
+	if got, want := executeSet(t, set, "a"), "foo"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if set.template("b") != nil {
+		t.Fatal("template for deleted file not removed")
+	}
+	if got, want := executeSet(t, set, "c"), "c"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestReloaderStart(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.tmpl": {Data: []byte("a")},
+		"b.tmpl": {Data: []byte("{{/b}}")},
+	}
+	set := NewSet()
+	r := NewReloader(set, fsys)
+	r.Interval = time.Millisecond
+	errc := make(chan error, 1)
+	r.OnError = func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+	r.Start()
+	err := <-errc
+	r.Stop()
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != ErrUnopened || e.Name != "b" {
+		t.Fatalf("got error %v, want unopened", err)
+	}
+	if got, want := executeSet(t, set, "a"), "a"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestReloadDefine(t *testing.T) {
+	mod := time.Unix(0, 0)
+	fsys := fstest.MapFS{
+		"a.tmpl": {Data: []byte("{{%define b}}b{{/b}}{{%define c}}c{{/c}}"), ModTime: mod},
+	}
+	set := NewSet()
+	r := NewReloader(set, fsys)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("couldn't reload: %v", err)
+	}
+	if set.template("b") == nil || set.template("c") == nil {
+		t.Fatal("defined templates not added")
+	}
+	mod = mod.Add(time.Second)
+	fsys["a.tmpl"] = &fstest.MapFile{Data: []byte("{{%define b}}b{{/b}}"), ModTime: mod}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("couldn't reload: %v", err)
+	}
+	if set.template("b") == nil || set.template("c") != nil {
+		t.Fatal("template no longer defined not removed")
+	}
+	delete(fsys, "a.tmpl")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("couldn't reload: %v", err)
+	}
+	if set.template("a") != nil || set.template("b") != nil {
+		t.Fatal("templates of deleted file not removed")
+	}
+}
+
+func TestReloadCycle(t *testing.T) {
+	mod := time.Unix(0, 0)
+	fsys := fstest.MapFS{
+		"a.tmpl": {Data: []byte("a{{>b}}"), ModTime: mod},
+		"b.tmpl": {Data: []byte("b{{%define c}}c{{/c}}"), ModTime: mod},
+	}
+	set := NewSet()
+	r := NewReloader(set, fsys)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("couldn't reload: %v", err)
+	}
+
+	// The new b is rejected and the old b and c are kept.
+	mod = mod.Add(time.Second)
+	fsys["b.tmpl"] = &fstest.MapFile{Data: []byte("B{{>a}}"), ModTime: mod}
+	err := r.Reload()
+	var errs ErrorList
+	var e *Error
+	if !errors.As(err, &errs) || len(errs) != 1 || !errors.As(errs[0], &e) || e.Kind != ErrCycle {
+		t.Fatalf("got error %v, want cycle", err)
+	}
+	if got, want := executeSet(t, set, "a"), "ab"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if set.template("c") == nil {
+		t.Fatal("template of rejected file removed")
+	}
+
+	// The rejected b is added once a no longer includes it.
+	mod = mod.Add(time.Second)
+	fsys["a.tmpl"] = &fstest.MapFile{Data: []byte("A"), ModTime: mod}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("couldn't reload: %v", err)
+	}
+	if got, want := executeSet(t, set, "b"), "BA"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if set.template("c") != nil {
+		t.Fatal("template no longer defined not removed")
+	}
+}
+
+func TestReloaderStopWithoutStart(t *testing.T) {
+	r := NewReloader(NewSet(), fstest.MapFS{})
+	r.Stop()
+	r.Start()
+	r.Stop()
+	r.Stop()
+}
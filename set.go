@@ -4,9 +4,12 @@
 package stem
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 )
 
@@ -14,6 +17,9 @@ import (
 type Set struct {
 	rwm   sync.RWMutex
 	cache map[string]*Template
+	funcs FuncMap
+	opts  ExecuteOptions
+	load  func(*Template) error // load is called on templates parsed from files.
 
 	// Design Note:
 	// A Set is meant to be used by multiple goroutines concurrently. To minimize
@@ -29,12 +35,198 @@ func NewSet() *Set {
 	}
 }
 
-// Add template to set or replace existing template. Once a template is added it
-// must never be used outside the set because it wouldn't be threadsafe.
-func (s *Set) Add(t *Template) {
+// Add template to set or replace existing template. Templates defined inside
+// the template are added with it. Once a template is added it must never be
+// used outside the set because it wouldn't be threadsafe. An ErrCycle error is
+// returned, and no template is added, if a template would always include
+// itself.
+func (s *Set) Add(t *Template) error {
 	s.rwm.Lock()
 	defer s.rwm.Unlock()
-	s.cache[t.name] = t
+	return s.add(t)
+}
+
+// add adds the template and the templates defined inside it, or none of them
+// if there is an include cycle. The caller must hold the lock.
+func (s *Set) add(t *Template) error {
+	tmpls := append([]*Template{t}, t.defines...)
+	old := make(map[string]*Template, len(tmpls))
+	for _, t := range tmpls {
+		if _, ok := old[t.name]; !ok {
+			old[t.name] = s.cache[t.name]
+		}
+		s.cache[t.name] = t
+	}
+	for _, t := range tmpls {
+		if err := s.cycle(t); err != nil {
+			for name, t := range old {
+				if t == nil {
+					delete(s.cache, name)
+				} else {
+					s.cache[name] = t
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// replacement is a template to add and the names it no longer defines, which
+// are deleted only if the template is added.
+type replacement struct {
+	t     *Template
+	stale []string
+}
+
+// swap deletes and adds templates while holding the lock so executions see
+// either none or all of the changes. A template that would create an include
+// cycle isn't added and the existing version is kept. The error for add[i] is
+// errs[i], or nil if it was added.
+func (s *Set) swap(add []replacement, del []string) []error {
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	for _, name := range del {
+		delete(s.cache, name)
+	}
+	errs := make([]error, len(add))
+	for i, r := range add {
+		if errs[i] = s.add(r.t); errs[i] != nil {
+			continue
+		}
+		for _, name := range r.stale {
+			delete(s.cache, name)
+		}
+	}
+	return errs
+}
+
+// cycle returns an error if adding t would create an include cycle. Only
+// includes outside of sections are followed. Recursion inside of a section is
+// left to the depth limit, an include inherits the scope of the caller so
+// "{{+x}}{{>a}}{{/x}}" in template a recurses until ErrDepth.
+func (s *Set) cycle(t *Template) error {
+	n, path := s.findCycle(t)
+	if n == nil {
+		return nil
+	}
+	return &Error{
+		Kind: ErrCycle,
+		Name: t.name,
+		Line: n.pos.line,
+		Col:  n.pos.col,
+		Tag:  n.pos.tag,
+		Err:  fmt.Errorf("include cycle %v -> %v", t.name, strings.Join(path, " -> ")),
+	}
+}
+
+// findCycle returns the include of t that starts an include cycle and the
+// names of the templates in the cycle, or nil if there isn't a cycle.
+func (s *Set) findCycle(t *Template) (*nodeInclude, []string) {
+	var path []string
+	seen := make(map[string]bool)
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		if len(path) > 0 && name == t.name {
+			return true
+		}
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+		tmpl := s.cache[name]
+		if name == t.name {
+			tmpl = t
+		}
+		if tmpl == nil {
+			return false
+		}
+		for _, inc := range includes(tmpl.tree) {
+			path = append(path, inc.name)
+			if visit(inc.name) {
+				return true
+			}
+			path = path[:len(path)-1]
+		}
+		return false
+	}
+	if !visit(t.name) {
+		return nil, nil
+	}
+	for _, n := range includes(t.tree) {
+		if n.name == path[0] {
+			return n, path
+		}
+	}
+	panic("include not found, programmer error")
+}
+
+// includes returns the includes which are not inside of a section, including
+// the ones in blocks. The parent of a template that extends another is
+// returned as an include because it is always rendered.
+func includes(tree []node) []*nodeInclude {
+	var inc []*nodeInclude
+	for _, n := range tree {
+		switch nt := n.(type) {
+		case *nodeBlock:
+			inc = append(inc, includes(nt.nodes)...)
+		case *nodeExtends:
+			inc = append(inc, &nodeInclude{pos: nt.pos, name: nt.name})
+		case *nodeInclude:
+			inc = append(inc, nt)
+		}
+	}
+	return inc
+}
+
+// SetOptions sets the options used when a template in the set is executed.
+func (s *Set) SetOptions(opts ExecuteOptions) {
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.opts = opts
+}
+
+// options returns a copy of the options.
+func (s *Set) options() *ExecuteOptions {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	opts := s.opts
+	return &opts
+}
+
+// Funcs adds formatters available to every template in the set. It panics if a
+// value in the map isn't a function that can be used as a formatter.
+func (s *Set) Funcs(funcs FuncMap) {
+	checkFuncs(funcs)
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	if s.funcs == nil {
+		s.funcs = make(FuncMap)
+	}
+	for name, fn := range funcs {
+		s.funcs[name] = fn
+	}
+}
+
+// OnLoad sets a function which is called with every template parsed by
+// ParseFS, ParseDir, ParseGlob or a Reloader before it's added to the set, for
+// example to call Template.Filter and Template.AutoEscape. A template isn't
+// added if the function returns an error.
+func (s *Set) OnLoad(fn func(t *Template) error) {
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.load = fn
+}
+
+// loaded calls the OnLoad function with t.
+func (s *Set) loaded(t *Template) error {
+	s.rwm.RLock()
+	load := s.load
+	s.rwm.RUnlock()
+	if load == nil {
+		return nil
+	}
+	return load(t)
 }
 
 // Del template from set.
@@ -55,24 +247,49 @@ func (s *Set) template(name string) *Template {
 	return nil
 }
 
-// Execute template with specified data.
-func (s *Set) Execute(wr io.Writer, name string, data map[string]interface{}) error {
+// fn returns a formatter in the set.
+func (s *Set) fn(name string) (interface{}, bool) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	fn, ok := s.funcs[name]
+	return fn, ok
+}
+
+// Execute template with specified data. The data is a map with string keys or a
+// struct.
+func (s *Set) Execute(wr io.Writer, name string, data interface{}) error {
+	return s.ExecuteContext(context.Background(), wr, name, data)
+}
+
+// ExecuteContext is like Execute but stops and returns ctx.Err() if the
+// context is canceled while looping over arrays and objects or including
+// templates.
+func (s *Set) ExecuteContext(ctx context.Context, wr io.Writer, name string, data interface{}) error {
 	t := s.template(name)
 	if t == nil {
-		return fmt.Errorf("template %q not found", name)
+		return &Error{Kind: ErrNotFound, Name: name, Err: errors.New("template not found")}
+	}
+	st := &state{ctx: ctx, done: ctx.Done(), set: s, tmpl: t, opts: s.options(), count: &counters{}}
+	if err := st.canceled(); err != nil {
+		return err
+	}
+	st.setWriter(wr)
+	err := st.render(newsymtab(data), t, nil)
+	if ferr := st.flush(); err == nil {
+		err = ferr
 	}
-	return executeRecurse(wr, s, newsymtab(data), t.tree)
+	return err
 }
 
 // ExecuteJSON executes template with specified JSON data.
 func (s *Set) ExecuteJSON(wr io.Writer, name, JSON string) error {
 	t := s.template(name)
 	if t == nil {
-		return fmt.Errorf("template %q not found", name)
+		return &Error{Kind: ErrNotFound, Name: name, Err: errors.New("template not found")}
 	}
 	data := make(map[string]interface{})
-	if err := json.Unmarshal([]byte(JSON), data); err != nil {
+	if err := json.Unmarshal([]byte(JSON), &data); err != nil {
 		return fmt.Errorf("couldn't unmarshal json, error: %v", err)
 	}
-	return executeRecurse(wr, s, newsymtab(data), t.tree)
+	return s.ExecuteContext(context.Background(), wr, name, data)
 }
@@ -0,0 +1,189 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// addTemplate parses the template and adds it to the set.
+func addTemplate(t *testing.T, set *Set, name, text string) error {
+	tmpl, err := Parse(text)
+	if err != nil {
+		t.Fatalf("couldn't parse template: %v", err)
+	}
+	tmpl.SetName(name)
+	return set.Add(tmpl)
+}
+
+func TestSetCycle(t *testing.T) {
+	set := NewSet()
+	if err := addTemplate(t, set, "a", "{{>b}}"); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	if err := addTemplate(t, set, "b", "{{#x}}{{>a}}{{/x}}{{>c}}"); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	err := addTemplate(t, set, "c", "x\n {{>a}}")
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != ErrCycle {
+		t.Fatalf("got error %v, want cycle", err)
+	}
+	if got, want := e.Error(), "c:2:2: include cycle c -> a -> b -> c: {{>a}}"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if set.template("c") != nil {
+		t.Fatal("template with cycle added")
+	}
+	if err := addTemplate(t, set, "d", "{{>d}}"); err == nil {
+		t.Fatal("expected error for self include")
+	}
+	if err := addTemplate(t, set, "e", "{{%block x}}{{>e}}{{/x}}"); !errors.As(err, &e) || e.Kind != ErrCycle || e.Tag != "{{>e}}" {
+		t.Fatalf("got error %v, want cycle through block", err)
+	}
+}
+
+func TestSetDepth(t *testing.T) {
+	set := NewSet()
+	set.SetOptions(ExecuteOptions{MaxDepth: 10})
+	if err := addTemplate(t, set, "a", "{{+x}}.{{>a}}{{/x}}"); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	got := bytes.NewBuffer(nil)
+	err := set.Execute(got, "a", map[string]interface{}{"x": true})
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != ErrDepth || e.Tag != "{{>a}}" {
+		t.Fatalf("got error %v, want depth", err)
+	}
+	if got, want := got.String(), "....."; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSetExtends(t *testing.T) {
+	set := NewSet()
+	templates := []struct {
+		name string
+		text string
+	}{
+		{"base", "<title>{{%block title}}Site{{/title}}</title>{{%block body}}<main>{{%block content}}{{/content}}</main>{{/body}}"},
+		{"page", "{{%extends base}}ignored{{%block title}}{{*title}}{{/title}}{{%block content}}{{>nav}}page{{/content}}"},
+		{"nav", "nav "},
+		{"article", "{{%extends page}}{{%block content}}article {{*title}}{{/content}}"},
+		{"orphan", "{{%extends missing}}"},
+	}
+	for _, tmpl := range templates {
+		if err := addTemplate(t, set, tmpl.name, tmpl.text); err != nil {
+			t.Fatalf("couldn't add template %q: %v", tmpl.name, err)
+		}
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"base", "<title>Site</title><main></main>"},
+		{"page", "<title>foo</title><main>nav page</main>"},
+		{"article", "<title>foo</title><main>article foo</main>"},
+	}
+	for _, test := range tests {
+		got := bytes.NewBuffer(nil)
+		if err := set.Execute(got, test.name, map[string]interface{}{"title": "foo"}); err != nil {
+			t.Fatalf("test %q, couldn't execute: %v", test.name, err)
+		}
+		if got.String() != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.name, got.String(), test.want)
+		}
+	}
+	err := set.Execute(bytes.NewBuffer(nil), "orphan", nil)
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != ErrNotFound || e.Name != "orphan" {
+		t.Fatalf("got error %v, want not found", err)
+	}
+	err = addTemplate(t, set, "base", "{{%extends article}}")
+	if !errors.As(err, &e) || e.Kind != ErrCycle {
+		t.Fatalf("got error %v, want cycle", err)
+	}
+}
+
+func TestSetIncludeArgs(t *testing.T) {
+	set := NewSet()
+	if err := addTemplate(t, set, "card", "[{{*name}} {{*size|default \"big\"}} {{*site}}{{*}}]"); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	data := map[string]interface{}{
+		"site":  "s",
+		"user":  map[string]interface{}{"name": "a"},
+		"users": []interface{}{map[string]interface{}{"name": "b"}, "c"},
+	}
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"{{>card}}", "[ big s]"},
+		{"{{>card user}}", "[a big s]"},
+		{"{{>card name=user.name size=\"small\"}}", "[a small s]"},
+		{"{{>card user size=1}}", "[a 1 s]"},
+		{"{{>card user name=\"x\"}}", "[x big s]"},
+		{"{{#users}}{{>card size=2}}{{/users}}", "[b 2 s][ 2 sc]"},
+		{"{{>card users.1}}", "[ big sc]"},
+		{"{{$user}}{{>card name=other.name}}{{/user}}", "[ big s]"},
+		{"{{$user}}{{>card size=other}}{{/user}}", "[a big s]"},
+	}
+	for _, test := range tests {
+		if err := addTemplate(t, set, "page", test.src); err != nil {
+			t.Fatalf("test %q, couldn't add template: %v", test.src, err)
+		}
+		got := bytes.NewBuffer(nil)
+		if err := set.Execute(got, "page", data); err != nil {
+			t.Fatalf("test %q, couldn't execute: %v", test.src, err)
+		}
+		if got.String() != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.src, got.String(), test.want)
+		}
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	tests := []struct {
+		name string         // name of test printed with errors.
+		src  string         // src is the template "a", "b" is "b{{*x}}".
+		opts ExecuteOptions // opts are the options of the set.
+		kind ErrorKind      // kind is the error expected.
+		want string         // want is the output before the error.
+	}{
+		{"output", "{{#x}}abc{{/x}}", ExecuteOptions{MaxOutputBytes: 7}, ErrOutputLimit, "abcabc"},
+		{"output print", "{{*y}}", ExecuteOptions{MaxOutputBytes: 2}, ErrOutputLimit, ""},
+		{"output include", "{{>b}}{{>b}}", ExecuteOptions{MaxOutputBytes: 3}, ErrOutputLimit, "b"},
+		{"nodes", "a{{*y}}{{#x}}b{{/x}}", ExecuteOptions{MaxNodes: 4}, ErrNodeLimit, "afoob"},
+		{"iterations", "{{#x}}{{#x}}.{{/x}}{{/x}}", ExecuteOptions{MaxIterations: 5}, ErrIterationLimit, "..."},
+		{"iterations each", "{{@z}}.{{/z}}", ExecuteOptions{MaxIterations: 1}, ErrIterationLimit, "."},
+		{"include depth", "{{#x}}{{>a}}{{/x}}", ExecuteOptions{MaxIncludeDepth: 2}, ErrIncludeDepth, ""},
+	}
+	data := map[string]interface{}{
+		"x": []interface{}{1, 2, 3},
+		"y": "foo",
+		"z": map[string]interface{}{"a": 1, "b": 2},
+	}
+	for _, test := range tests {
+		set := NewSet()
+		set.SetOptions(test.opts)
+		if err := addTemplate(t, set, "a", test.src); err != nil {
+			t.Fatalf("test %q, couldn't add template: %v", test.name, err)
+		}
+		if err := addTemplate(t, set, "b", "b{{*x}}"); err != nil {
+			t.Fatalf("test %q, couldn't add template: %v", test.name, err)
+		}
+		got := bytes.NewBuffer(nil)
+		err := set.Execute(got, "a", data)
+		var e *Error
+		if !errors.As(err, &e) || e.Kind != test.kind {
+			t.Fatalf("test %q, got error %v, want %v", test.name, err, test.kind)
+		}
+		if got.String() != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.name, got.String(), test.want)
+		}
+	}
+}
@@ -6,12 +6,56 @@ package stem
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // Symbol table.
 type symtab struct {
 	scope     []reflect.Value // scopes has inner most scope as the last elem.
 	arrayElem reflect.Value   // arrayElem is zero value except when in array.
+	loop      *loop           // loop is nil except when in array.
+}
+
+// includeArgs are the named arguments of an include by name. An undefined
+// argument is the zero value.
+type includeArgs map[string]reflect.Value
+
+var includeArgsType = reflect.TypeOf(includeArgs(nil))
+
+// loop is the position in the inner most array or object.
+type loop struct {
+	index  int
+	length int
+	key    string // key of the object entry.
+	object bool   // object is true if iterating over an object.
+}
+
+// value returns the loop symbol, or the zero value if it isn't one. Loop
+// symbols start with "@" so they can't collide with keys in the data.
+func (l *loop) value(symbol string) reflect.Value {
+	if l == nil {
+		return reflect.Value{}
+	}
+	switch symbol {
+	case "@index":
+		return reflect.ValueOf(l.index)
+	case "@index1":
+		return reflect.ValueOf(l.index + 1)
+	case "@first":
+		return reflect.ValueOf(l.index == 0)
+	case "@last":
+		return reflect.ValueOf(l.index == l.length-1)
+	case "@length":
+		return reflect.ValueOf(l.length)
+	case "@key":
+		if l.object {
+			return reflect.ValueOf(l.key)
+		}
+	}
+	return reflect.Value{}
 }
 
 // indirect all interfaces/pointers.
@@ -30,24 +74,242 @@ loop:
 	return v
 }
 
-func newsymtab(data map[string]interface{}) *symtab {
+// field returns the value of the key in the object v or the zero value. An
+// object is a map with string keys or a struct. Struct fields are named by
+// their json tag if they have one. An array element is accessed by index.
+func field(v reflect.Value, key string) reflect.Value {
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.Array, reflect.Slice:
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < v.Len() {
+			return v.Index(i)
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return reflect.Value{}
+		}
+		return v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+	case reflect.Struct:
+		if i, ok := structFields(v.Type())[key]; ok {
+			return fieldByIndex(v, i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex except it returns the zero
+// value instead of panicking on a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for x, i := range index {
+		if x > 0 {
+			v = indirect(v)
+			if !v.IsValid() {
+				return reflect.Value{}
+			}
+		}
+		v = v.Field(i)
+	}
+	return v
+}
+
+// fieldCache maps a struct type to the index of its fields by name.
+var fieldCache sync.Map
+
+// structFields returns the exported fields of a struct type by name. Fields of
+// embedded structs are promoted unless shadowed, like encoding/json.
+func structFields(t reflect.Type) map[string][]int {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(map[string][]int)
+	}
+	fields := make(map[string][]int)
+	var embedded [][]int
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			embedded = append(embedded, sf.Index)
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields[name] = sf.Index
+	}
+	for _, index := range embedded {
+		ft := t.FieldByIndex(index).Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		for name, i := range structFields(ft) {
+			if _, ok := fields[name]; !ok {
+				fields[name] = append(append([]int{}, index...), i...)
+			}
+		}
+	}
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// isArray returns true if v is a non-nil slice or an array.
+func isArray(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array:
+		return true
+	case reflect.Slice:
+		return !v.IsNil()
+	}
+	return false
+}
+
+// isObject returns true if v is a non-nil map with string keys or a struct.
+func isObject(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Map:
+		return !v.IsNil() && v.Type().Key().Kind() == reflect.String
+	case reflect.Struct:
+		return true
+	}
+	return false
+}
+
+// objectKeys returns the keys of an object in sorted order.
+func objectKeys(v reflect.Value) []string {
+	var keys []string
+	switch v.Kind() {
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+	case reflect.Struct:
+		for name := range structFields(v.Type()) {
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sprint returns the string representation of v. Builtin scalar types are
+// formatted with strconv, which gives the same output as fmt without boxing
+// the value in an interface.
+func sprint(v reflect.Value) string {
+	v = indirect(v)
+	if !v.IsValid() || !v.CanInterface() {
+		return ""
+	}
+	// Named types may have a String method so they're printed with fmt.
+	if v.Type().PkgPath() == "" {
+		switch v.Kind() {
+		case reflect.String:
+			return v.String()
+		case reflect.Bool:
+			return strconv.FormatBool(v.Bool())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return strconv.FormatInt(v.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return strconv.FormatUint(v.Uint(), 10)
+		case reflect.Float32:
+			return strconv.FormatFloat(v.Float(), 'g', -1, 32)
+		case reflect.Float64:
+			return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+		}
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func newsymtab(data interface{}) *symtab {
 	return &symtab{
-		scope: []reflect.Value{reflect.ValueOf(data)},
+		scope: []reflect.Value{indirect(reflect.ValueOf(data))},
 	}
 }
 
-// Array returns a slice or the zero value.
-func (s *symtab) Array(key string) reflect.Value {
-	v := reflect.ValueOf(key)
+// parsePath splits a symbol name in to keys. Keys are separated by "." and a
+// key that contains "." or "[" can be quoted in brackets, for example
+// a["b.c"].d.
+func parsePath(name string) ([]string, error) {
+	if !strings.ContainsAny(name, ".[") {
+		return []string{name}, nil
+	}
+	var path []string
+	for s := name; ; {
+		var key string
+		if strings.HasPrefix(s, "[") {
+			q, err := strconv.QuotedPrefix(s[1:])
+			if err != nil || !strings.HasPrefix(s[1+len(q):], "]") {
+				return nil, fmt.Errorf("malformed key in %q", name)
+			}
+			key, _ = strconv.Unquote(q)
+			s = s[len(q)+2:]
+		} else {
+			i := strings.IndexAny(s, ".[")
+			if i == -1 {
+				i = len(s)
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("empty key in %q", name)
+			}
+			key, s = s[:i], s[i:]
+		}
+		path = append(path, key)
+		if s == "" {
+			return path, nil
+		}
+		if s[0] == '.' {
+			s = s[1:]
+		}
+	}
+}
+
+// lookup returns the value of the symbol, or the zero value. The first key of
+// the path is looked up from the inner most to the outer most scope. The rest
+// of the keys are looked up relative to the first.
+func (s *symtab) lookup(symbol string) reflect.Value {
+	if strings.HasPrefix(symbol, "@") {
+		return s.loop.value(symbol)
+	}
+	path, err := parsePath(symbol)
+	if err != nil {
+		return reflect.Value{}
+	}
+	var e reflect.Value
 	for x := len(s.scope) - 1; x >= 0; x-- {
-		if e := s.scope[x].MapIndex(v); e.IsValid() {
-			e = indirect(e)
-			if e.Kind() == reflect.Slice && e.IsValid() && !e.IsNil() {
-				return e
+		if v := s.scope[x]; v.Kind() == reflect.Map && v.Type() == includeArgsType {
+			// A passed argument hides the outer scopes even if it's undefined.
+			if a, ok := v.Interface().(includeArgs)[path[0]]; ok {
+				e = a
+				break
 			}
+			continue
+		}
+		if e = field(s.scope[x], path[0]); e.IsValid() {
 			break
 		}
 	}
+	for _, key := range path[1:] {
+		if !e.IsValid() {
+			break
+		}
+		e = field(e, key)
+	}
+	return e
+}
+
+// Array returns a slice or array, or the zero value.
+func (s *symtab) Array(key string) reflect.Value {
+	if e := indirect(s.lookup(key)); isArray(e) {
+		return e
+	}
 	return reflect.Value{}
 }
 
@@ -56,14 +318,70 @@ func (s *symtab) EnterArrayElem(elem reflect.Value) *symtab {
 	return &symtab{
 		scope:     s.scope,
 		arrayElem: elem,
+		loop:      s.loop,
+	}
+}
+
+// EnterLoop returns the symbol table at index i of an array with length n.
+func (s *symtab) EnterLoop(i, n int) *symtab {
+	return &symtab{
+		scope:     s.scope,
+		arrayElem: s.arrayElem,
+		loop:      &loop{index: i, length: n},
+	}
+}
+
+// EnterEntry returns the symbol table at entry i of an object with n entries.
+func (s *symtab) EnterEntry(i, n int, key string) *symtab {
+	return &symtab{
+		scope:     s.scope,
+		arrayElem: s.arrayElem,
+		loop:      &loop{index: i, length: n, key: key, object: true},
 	}
 }
 
+// EnterElem returns the symbol table for an element of an array or object, or
+// the scope of an include. An object is entered as the inner most scope. A
+// struct is also the array element so a value such as a time.Time is still
+// printed by "{{*}}", a map isn't so "{{*}}" prints nothing for JSON objects.
+func (s *symtab) EnterElem(elem reflect.Value) *symtab {
+	if !isObject(elem) {
+		return s.EnterArrayElem(elem)
+	}
+	inner := s.EnterObject(elem)
+	if elem.Kind() == reflect.Struct {
+		inner.arrayElem = elem
+	}
+	return inner
+}
+
 // EnterObject returns the symbol table with obj as the inner most scope.
 func (s *symtab) EnterObject(obj reflect.Value) *symtab {
 	return &symtab{
-		scope: append(s.scope, obj),
+		scope: append(s.scope[:len(s.scope):len(s.scope)], obj),
+		loop:  s.loop,
+	}
+}
+
+// truthy returns false if v is undefined, false, null, 0, "" or an empty array
+// or object. Everything else is true.
+func truthy(v reflect.Value) bool {
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.Invalid:
+		return false
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() != 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() != 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() != 0
+	case reflect.String, reflect.Array, reflect.Slice, reflect.Map:
+		return v.Len() != 0
 	}
+	return true
 }
 
 // Ifdef returns true if the key is defined.
@@ -71,13 +389,7 @@ func (s *symtab) Ifdef(key string) bool {
 	if key == "" && s.arrayElem.IsValid() {
 		return true
 	}
-	v := reflect.ValueOf(key)
-	for x := len(s.scope) - 1; x >= 0; x-- {
-		if e := s.scope[x].MapIndex(v); e.IsValid() {
-			return true
-		}
-	}
-	return false
+	return s.lookup(key).IsValid()
 }
 
 // Ifndef returns true if the key is not defined.
@@ -87,29 +399,21 @@ func (s *symtab) Ifndef(symbol string) bool {
 
 // Print returns the string representation of the value.
 func (s *symtab) Print(symbol string) string {
+	return sprint(s.Value(symbol))
+}
+
+// Value returns the value of the symbol or the zero value.
+func (s *symtab) Value(symbol string) reflect.Value {
 	if symbol == "" && s.arrayElem.IsValid() {
-		return fmt.Sprint(indirect(s.arrayElem).Interface())
+		return s.arrayElem
 	}
-	v := reflect.ValueOf(symbol)
-	for x := len(s.scope) - 1; x >= 0; x-- {
-		if e := s.scope[x].MapIndex(v); e.IsValid() {
-			return fmt.Sprint(indirect(e).Interface())
-		}
-	}
-	return ""
+	return s.lookup(symbol)
 }
 
-// Object returns a map or the zero value.
+// Object returns a map or struct, or the zero value.
 func (s *symtab) Object(symbol string) reflect.Value {
-	v := reflect.ValueOf(symbol)
-	for x := len(s.scope) - 1; x >= 0; x-- {
-		if e := s.scope[x].MapIndex(v); e.IsValid() {
-			e = indirect(e)
-			if e.Kind() == reflect.Map && e.IsValid() && !e.IsNil() {
-				return e
-			}
-			break
-		}
+	if e := indirect(s.lookup(symbol)); isObject(e) {
+		return e
 	}
 	return reflect.Value{}
 }
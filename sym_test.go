@@ -4,6 +4,7 @@
 package stem
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -16,6 +17,67 @@ func TestArray(t *testing.T) {
 	}
 }
 
+func TestTruthy(t *testing.T) {
+	st := newsymtab(map[string]interface{}{
+		"false": false,
+		"null":  nil,
+		"zero":  0.0,
+		"empty": "",
+		"array": []interface{}{},
+		"obj":   map[string]interface{}{},
+		"true":  true,
+		"num":   -1,
+		"str":   "0",
+		"full":  []interface{}{false},
+		"struc": struct{}{},
+	})
+	for _, key := range []string{"false", "null", "zero", "empty", "array", "obj", "undefined"} {
+		if truthy(st.Value(key)) {
+			t.Fatalf("%q is truthy", key)
+		}
+	}
+	for _, key := range []string{"true", "num", "str", "full", "struc"} {
+		if !truthy(st.Value(key)) {
+			t.Fatalf("%q is falsy", key)
+		}
+	}
+}
+
+func TestLoop(t *testing.T) {
+	st := newsymtab(map[string]interface{}{"@length": 5})
+	if st.Ifdef("@length") {
+		t.Fatal("loop symbol defined outside of loop")
+	}
+	st = st.EnterLoop(2, 3)
+	for symbol, want := range map[string]string{
+		"@index":  "2",
+		"@index1": "3",
+		"@first":  "false",
+		"@last":   "true",
+		"@length": "3",
+		"@other":  "",
+	} {
+		if got := st.Print(symbol); got != want {
+			t.Fatalf("symbol %q, got %q, want %q", symbol, got, want)
+		}
+	}
+}
+
+func TestObjectKeys(t *testing.T) {
+	s := struct {
+		B string `json:"b"`
+		A string
+		c string
+	}{}
+	if got, want := objectKeys(reflect.ValueOf(s)), []string{"A", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	m := map[string]int{"z": 0, "y": 1}
+	if got, want := objectKeys(reflect.ValueOf(m)), []string{"y", "z"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
 func TestIfdef(t *testing.T) {
 	st := newsymtab(map[string]interface{}{
 		"a": "b",
@@ -25,6 +87,54 @@ func TestIfdef(t *testing.T) {
 	}
 }
 
+func TestIfdefStruct(t *testing.T) {
+	type S struct {
+		A *string `json:"a,omitempty"`
+		b string
+	}
+	st := newsymtab(S{})
+	if !st.Ifdef("a") {
+		t.Fatal("ifdef test failed")
+	}
+	if st.Ifdef("b") || st.Ifdef("A") {
+		t.Fatal("unexported or renamed field defined")
+	}
+	if got := st.Print("a"); got != "" {
+		t.Fatalf("got %q, want empty string", got)
+	}
+}
+
+func TestPath(t *testing.T) {
+	st := newsymtab(map[string]interface{}{
+		"a": map[string]interface{}{
+			"b.c": map[string]interface{}{"d": "0"},
+			"e":   []interface{}{"1", "2"},
+		},
+	})
+	st = st.EnterObject(reflect.ValueOf(map[string]interface{}{"f": "3"}))
+	tests := []struct {
+		name string // name is the symbol.
+		want string // want this output.
+	}{
+		{`a["b.c"].d`, "0"},
+		{`a["b.c"]["d"]`, "0"},
+		{"a.e.1", "2"},
+		{"a.e.2", ""},
+		{"a.f", ""},
+		{"f", "3"},
+	}
+	for _, test := range tests {
+		if got := st.Print(test.name); got != test.want {
+			t.Fatalf("symbol %q, got %q, want %q", test.name, got, test.want)
+		}
+	}
+	for _, name := range []string{"a.", ".a", "a..b", `a["b"`, "a[b]"} {
+		if _, err := parsePath(name); err == nil {
+			t.Fatalf("expected error for %q", name)
+		}
+	}
+}
+
 func TestIfndef(t *testing.T) {
 	st := newsymtab(map[string]interface{}{
 		"a": "b",
@@ -51,3 +161,33 @@ func TestPrint(t *testing.T) {
 		t.Fatalf("got %v, want %v", got, want)
 	}
 }
+
+// named has a String method which sprint must use.
+type named int
+
+func (n named) String() string {
+	return "named"
+}
+
+func TestSprint(t *testing.T) {
+	tests := []struct {
+		val  interface{}
+		want string
+	}{
+		{nil, ""},
+		{"a", "a"},
+		{true, "true"},
+		{-3, "-3"},
+		{uint8(7), "7"},
+		{1.5, "1.5"},
+		{1e21, "1e+21"},
+		{float32(1.1), "1.1"},
+		{named(1), "named"},
+		{[]int{1, 2}, "[1 2]"},
+	}
+	for _, test := range tests {
+		if got := sprint(reflect.ValueOf(test.val)); got != test.want {
+			t.Fatalf("test %v, got %q, want %q", test.val, got, test.want)
+		}
+	}
+}
@@ -4,6 +4,8 @@
 package stem
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,83 +17,490 @@ import (
 // Compiled template ready to be combined with data.
 // Multiple goroutines can use tmpl concurrently.
 type Template struct {
-	name string
-	tree []node
+	name    string
+	tree    []node
+	funcs   FuncMap
+	opts    ExecuteOptions
+	defines []*Template // defines are the templates defined inside this one.
+	esc     *contexts   // esc is nil unless the template is auto-escaped.
 }
 
+// state of a template execution.
+type state struct {
+	ctx    context.Context
+	done   <-chan struct{} // done is ctx.Done(), nil if ctx can't be canceled.
+	wr     io.StringWriter
+	buf    *bufio.Writer // buf is flushed when execution ends, may be nil.
+	set    *Set          // set is nil unless the Set is being executed.
+	tmpl   *Template     // tmpl is the template being executed.
+	root   *Template     // root is the template Execute was called on.
+	opts   *ExecuteOptions
+	depth  int              // depth is the number of nested sections and includes.
+	blocks map[string]block // blocks replace the blocks of the template.
+	incs   int              // incs is the number of nested includes.
+	count  *counters        // count is shared by included templates.
+}
+
+// counters are checked against the limits in ExecuteOptions.
+type counters struct {
+	bytes      int64
+	nodes      int
+	iterations int
+}
+
+// block replaces the block with the same name in a parent template.
+type block struct {
+	tmpl *Template // tmpl is the template the block is defined in.
+	n    *nodeBlock
+}
+
+// body executes the nodes of a section, or the else nodes if alt is true.
+type body func(sym *symtab, alt bool) error
+
 // executeRecurse recursively parses. Every time we encounter a node which
 // contains other nodes we recurse and push a new symbol table on to the stack
 // for recursive lookup.
-func executeRecurse(wr io.Writer, set *Set, sym *symtab, tree []node) error {
+func executeRecurse(st *state, sym *symtab, tree []node) error {
+	if err := st.enter(); err != nil {
+		return err
+	}
+	defer st.leave()
 	for _, n := range tree {
-		switch nt := n.(type) {
-		case *nodeArray:
-			array := sym.Array(nt.name)
-			if array.IsValid() {
-				for i := 0; i < array.Len(); i++ {
-					elem := indirect(array.Index(i))
-					if elem.Kind() == reflect.Map && !elem.IsNil() {
-						if err := executeRecurse(wr, set, sym.EnterObject(elem), nt.nodes); err != nil {
-							return err
-						}
-					} else {
-						if err := executeRecurse(wr, set, sym.EnterArrayElem(elem), nt.nodes); err != nil {
-							return err
-						}
-					}
-				}
+		if err := st.exec(sym, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enter is called before executing nested nodes. It returns an error if
+// MaxDepth is exceeded. Every call must be followed by a call to leave.
+func (st *state) enter() error {
+	st.depth++
+	if st.depth > st.opts.maxDepth() {
+		return st.error(ErrDepth, pos{}, fmt.Errorf("depth limit %v", st.opts.maxDepth()))
+	}
+	return nil
+}
+
+// leave is called after executing nested nodes.
+func (st *state) leave() {
+	st.depth--
+}
+
+// exec executes a node of the parse tree.
+func (st *state) exec(sym *symtab, n node) error {
+	if err := st.countNode(n); err != nil {
+		return err
+	}
+	switch nt := n.(type) {
+	case *nodeBlock:
+		if b, ok := st.blocks[nt.name]; ok && b.n != nt {
+			inner := *st
+			inner.tmpl = b.tmpl
+			nodes, err := b.tmpl.escapedIn(b.n, nt.ctx)
+			if err != nil {
+				return err
 			}
-		case *nodeIfdef:
-			if sym.Ifdef(nt.name) {
-				if err := executeRecurse(wr, set, sym, nt.nodes); err != nil {
-					return err
-				}
+			return executeRecurse(&inner, sym, nodes)
+		}
+		return executeRecurse(st, sym, nt.nodes)
+	case *nodeExtends:
+		// The parent was rendered instead of this template.
+		return nil
+	case *nodeInclude:
+		t := st.template(nt.name)
+		return st.include(sym, nt, t != nil, func(inc *state, sym *symtab) error {
+			return inc.render(sym, t, nt.ctx)
+		})
+	case *nodePrint:
+		return st.execPrint(sym, nt)
+	case *nodeString:
+		return st.write(pos{}, nt.val)
+	}
+	return st.section(sym, n, func(sym *symtab, alt bool) error {
+		nodes, altNodes := children(n)
+		if alt {
+			return executeRecurse(st, sym, altNodes)
+		}
+		return executeRecurse(st, sym, nodes)
+	})
+}
+
+// countNode returns an error if MaxNodes is exceeded.
+func (st *state) countNode(n node) error {
+	if st.count.nodes++; st.opts.MaxNodes > 0 && st.count.nodes > st.opts.MaxNodes {
+		return st.error(ErrNodeLimit, nodePos(n), fmt.Errorf("node limit %v", st.opts.MaxNodes))
+	}
+	return nil
+}
+
+// children returns the nodes and else nodes of a section.
+func children(n node) (nodes, alt []node) {
+	switch nt := n.(type) {
+	case *nodeArray:
+		return nt.nodes, nt.alt
+	case *nodeEach:
+		return nt.nodes, nt.alt
+	case *nodeIf:
+		return nt.nodes, nt.alt
+	case *nodeIfdef:
+		return nt.nodes, nt.alt
+	case *nodeIfndef:
+		return nt.nodes, nt.alt
+	case *nodeObject:
+		return nt.nodes, nt.alt
+	}
+	panic("unknown node type, programmer error")
+}
+
+// section executes an array, each, if, ifdef, ifndef or object section. The
+// body is called once for every repetition of the section, or with alt true if
+// the else nodes should render.
+func (st *state) section(sym *symtab, n node, b body) error {
+	switch nt := n.(type) {
+	case *nodeArray:
+		array := sym.Array(nt.name)
+		if !array.IsValid() || array.Len() == 0 {
+			if err := st.missingSection(sym, nt.pos, nt.name, nt.alt); err != nil {
+				return err
 			}
-		case *nodeIfndef:
-			if sym.Ifndef(nt.name) {
-				if err := executeRecurse(wr, set, sym, nt.nodes); err != nil {
-					return err
-				}
+			return b(sym, true)
+		}
+		for i := 0; i < array.Len(); i++ {
+			if err := st.iterate(nt.pos); err != nil {
+				return err
 			}
-		case *nodeInclude:
-			if set != nil {
-				if t := set.template(nt.name); t != nil {
-					if err := executeRecurse(wr, set, sym, t.tree); err != nil {
-						return err
-					}
-				}
+			inner := sym.EnterLoop(i, array.Len()).EnterElem(indirect(array.Index(i)))
+			if err := b(inner, false); err != nil {
+				return err
 			}
-		case *nodeObject:
-			obj := sym.Object(nt.name)
-			if obj.IsValid() {
-				if err := executeRecurse(wr, set, sym.EnterObject(obj), nt.nodes); err != nil {
-					return err
-				}
+		}
+		return nil
+	case *nodeEach:
+		var keys []string
+		obj := sym.Object(nt.name)
+		if obj.IsValid() {
+			keys = objectKeys(obj)
+		}
+		if len(keys) == 0 {
+			if err := st.missingSection(sym, nt.pos, nt.name, nt.alt); err != nil {
+				return err
 			}
-		case *nodePrint:
-			if _, err := wr.Write([]byte(sym.Print(nt.name))); err != nil {
+			return b(sym, true)
+		}
+		for i, key := range keys {
+			if err := st.iterate(nt.pos); err != nil {
 				return err
 			}
-		case *nodeString:
-			if _, err := wr.Write([]byte(nt.val)); err != nil {
+			inner := sym.EnterEntry(i, len(keys), key).EnterElem(indirect(field(obj, key)))
+			if err := b(inner, false); err != nil {
 				return err
 			}
-		default:
-			panic("unknown node type, programmer error")
+		}
+		return nil
+	case *nodeIf:
+		return b(sym, !truthy(nt.expr.eval(sym)))
+	case *nodeIfdef:
+		return b(sym, !sym.Ifdef(nt.name))
+	case *nodeIfndef:
+		return b(sym, !sym.Ifndef(nt.name))
+	case *nodeObject:
+		obj := sym.Object(nt.name)
+		if !obj.IsValid() {
+			if err := st.missingSection(sym, nt.pos, nt.name, nt.alt); err != nil {
+				return err
+			}
+			return b(sym, true)
+		}
+		return b(sym.EnterObject(obj), false)
+	}
+	panic("unknown node type, programmer error")
+}
+
+// include executes an include. The run function executes the included
+// template with a copy of the state, it's only called if found is true.
+func (st *state) include(sym *symtab, n *nodeInclude, found bool, run func(inc *state, sym *symtab) error) error {
+	if !found {
+		switch st.opts.MissingKey {
+		case MissingError:
+			return st.error(ErrMissing, n.pos, fmt.Errorf("template %q not found", n.name))
+		case MissingKeep:
+			return st.write(n.pos, n.pos.tag)
+		}
+		return nil
+	}
+	if st.depth >= st.opts.maxDepth() {
+		return st.error(ErrDepth, n.pos, fmt.Errorf("depth limit %v", st.opts.maxDepth()))
+	}
+	if max := st.opts.MaxIncludeDepth; max > 0 && st.incs >= max {
+		return st.error(ErrIncludeDepth, n.pos, fmt.Errorf("include depth limit %v", max))
+	}
+	if err := st.canceled(); err != nil {
+		return err
+	}
+	inc := *st
+	inc.incs++
+	return run(&inc, includeScope(sym, n))
+}
+
+// execPrint writes the output of a print node.
+func (st *state) execPrint(sym *symtab, n *nodePrint) error {
+	s, err := st.print(sym, n)
+	if err != nil {
+		return err
+	}
+	return st.write(n.pos, s)
+}
+
+// render executes the template. If the template extends a parent the blocks of
+// every template in the chain are collected, the most derived block winning,
+// and the template at the root of the chain is executed instead. The context
+// is where the template is included, or nil.
+func (st *state) render(sym *symtab, t *Template, ctx *htmlContext) error {
+	var blocks map[string]block
+	seen := make(map[string]bool)
+	for {
+		ext := extends(t.tree)
+		if ext == nil {
+			break
+		}
+		if blocks == nil {
+			blocks = make(map[string]block)
+		}
+		collectBlocks(t, t.tree, blocks)
+		seen[t.name] = true
+		parent := st.template(ext.name)
+		if parent == nil {
+			return (&state{tmpl: t}).error(ErrNotFound, ext.pos, fmt.Errorf("template %q not found", ext.name))
+		}
+		if seen[parent.name] {
+			return (&state{tmpl: t}).error(ErrCycle, ext.pos, fmt.Errorf("template %q extends itself", parent.name))
+		}
+		t = parent
+	}
+	inner := *st
+	inner.tmpl = t
+	inner.blocks = blocks
+	nodes, err := t.escapedIn(nil, ctx)
+	if err != nil {
+		return err
+	}
+	return executeRecurse(&inner, sym, nodes)
+}
+
+// includeScope returns the symbol table an included template is executed with.
+// The scope of the include is entered first, then the named arguments, so
+// names not passed to the include are still found in the caller. A passed
+// argument hides the caller's value of the same name even if it's undefined.
+// Arguments are evaluated in the scope of the caller.
+func includeScope(sym *symtab, n *nodeInclude) *symtab {
+	inner := sym
+	if n.scope != nil {
+		inner = sym.EnterElem(indirect(n.scope.eval(sym)))
+	}
+	if n.args != nil {
+		args := make(includeArgs, len(n.args))
+		for _, a := range n.args {
+			v := a.val.eval(sym)
+			if v.IsValid() && !v.CanInterface() {
+				v = reflect.Value{}
+			}
+			args[a.name] = v
+		}
+		elem := inner.arrayElem
+		inner = inner.EnterObject(reflect.ValueOf(args))
+		inner.arrayElem = elem
+	}
+	return inner
+}
+
+// extends returns the extends tag of the template or nil if it doesn't extend
+// a parent.
+func extends(tree []node) *nodeExtends {
+	for _, n := range tree {
+		if nt, ok := n.(*nodeExtends); ok {
+			return nt
+		}
+	}
+	return nil
+}
+
+// collectBlocks adds the blocks of a template that extends a parent, including
+// blocks nested in blocks. Blocks already in the map are more derived and are
+// kept.
+func collectBlocks(t *Template, tree []node, blocks map[string]block) {
+	for _, n := range tree {
+		if nt, ok := n.(*nodeBlock); ok {
+			if _, ok := blocks[nt.name]; !ok {
+				blocks[nt.name] = block{tmpl: t, n: nt}
+			}
+			collectBlocks(t, nt.nodes, blocks)
+		}
+	}
+}
+
+// write writes s unless it would exceed MaxOutputBytes. The position is of the
+// tag being written, or the zero position for a string.
+func (st *state) write(p pos, s string) error {
+	if max := st.opts.MaxOutputBytes; max > 0 && st.count.bytes+int64(len(s)) > max {
+		return st.error(ErrOutputLimit, p, fmt.Errorf("output limit %v bytes", max))
+	}
+	st.count.bytes += int64(len(s))
+	_, err := st.wr.WriteString(s)
+	return err
+}
+
+// iterate is called before every repetition of a section. It returns an error
+// if MaxIterations is exceeded or the context is done.
+func (st *state) iterate(p pos) error {
+	if st.count.iterations++; st.opts.MaxIterations > 0 && st.count.iterations > st.opts.MaxIterations {
+		return st.error(ErrIterationLimit, p, fmt.Errorf("iteration limit %v", st.opts.MaxIterations))
+	}
+	return st.canceled()
+}
+
+// nodePos returns the position of a node, or the zero position for a string.
+func nodePos(n node) pos {
+	switch nt := n.(type) {
+	case *nodeArray:
+		return nt.pos
+	case *nodeBlock:
+		return nt.pos
+	case *nodeEach:
+		return nt.pos
+	case *nodeExtends:
+		return nt.pos
+	case *nodeIf:
+		return nt.pos
+	case *nodeIfdef:
+		return nt.pos
+	case *nodeIfndef:
+		return nt.pos
+	case *nodeInclude:
+		return nt.pos
+	case *nodeObject:
+		return nt.pos
+	case *nodePrint:
+		return nt.pos
+	}
+	return pos{}
+}
+
+// canceled returns the error of the context if it is done.
+func (st *state) canceled() error {
+	select {
+	case <-st.done:
+		return st.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// error returns an *Error for the tag at p in the template being executed.
+func (st *state) error(kind ErrorKind, p pos, err error) error {
+	return &Error{
+		Kind: kind,
+		Name: st.tmpl.name,
+		Line: p.line,
+		Col:  p.col,
+		Tag:  p.tag,
+		Err:  err,
+	}
+}
+
+// template returns the template with the specified name from the Set, or from
+// the templates defined in the executed template if there is no Set.
+func (st *state) template(name string) *Template {
+	if st.set != nil {
+		return st.set.template(name)
+	}
+	for _, t := range st.root.defines {
+		if t.name == name {
+			return t
 		}
 	}
 	return nil
 }
 
+// fn returns the formatter with the specified name. Formatters in the template
+// take precedence over formatters in the Set, which take precedence over the
+// builtin formatters.
+func (st *state) fn(name string) (interface{}, bool) {
+	if fn, ok := st.tmpl.funcs[name]; ok {
+		return fn, true
+	}
+	if st.set != nil {
+		if fn, ok := st.set.fn(name); ok {
+			return fn, true
+		}
+	}
+	fn, ok := builtins[name]
+	return fn, ok
+}
+
+// missingSection returns an error if the section at p didn't render because
+// the name isn't defined and MissingError is set. Sections with an else never
+// return an error.
+func (st *state) missingSection(sym *symtab, p pos, name string, alt []node) error {
+	if st.opts.MissingKey != MissingError || alt != nil || sym.Ifdef(name) {
+		return nil
+	}
+	return st.error(ErrMissing, p, fmt.Errorf("%q not defined", name))
+}
+
+// print returns the output of a print node after formatting and escaping.
+func (st *state) print(sym *symtab, n *nodePrint) (string, error) {
+	var s string
+	v := sym.Value(n.name)
+	if !v.IsValid() && st.opts.MissingKey != MissingZero && !n.hasDefault() {
+		if st.opts.MissingKey == MissingKeep {
+			return n.pos.tag, nil
+		}
+		return "", st.error(ErrMissing, n.pos, fmt.Errorf("%q not defined", n.name))
+	}
+	if n.pipe == nil {
+		s = sprint(v)
+	} else {
+		for _, c := range n.pipe {
+			fn, ok := st.fn(c.name)
+			if !ok {
+				return "", st.error(ErrExec, n.pos, fmt.Errorf("unknown formatter %q", c.name))
+			}
+			var err error
+			if v, err = c.apply(fn, v); err != nil {
+				return "", st.error(ErrExec, n.pos, err)
+			}
+		}
+		s = sprint(v)
+	}
+	for _, e := range n.esc {
+		s = e.escape(s)
+	}
+	return s, nil
+}
+
 // Parse template.
 func Parse(text string) (*Template, error) {
-	tree, err := parse("", text)
+	return parseNamed("", text)
+}
+
+// parseNamed parses a template with the specified name. Templates defined with
+// "{{%define name}}" are removed from the tree.
+func parseNamed(name, text string) (*Template, error) {
+	tree, err := parse(name, text)
 	if err != nil {
 		return nil, err
 	}
-	return &Template{
-		tree: tree,
-	}, nil
+	tmpl := &Template{name: name}
+	for _, n := range tree {
+		if nt, ok := n.(*nodeDefine); ok {
+			tmpl.defines = append(tmpl.defines, &Template{name: nt.name, tree: nt.nodes})
+			continue
+		}
+		tmpl.tree = append(tmpl.tree, n)
+	}
+	return tmpl, nil
 }
 
 // ParseFile parses a template file. The template name will be file name.
@@ -100,12 +509,7 @@ func ParseFile(filename string) (*Template, error) {
 	if err != nil {
 		return nil, fmt.Errorf("couldn't open file %q, error: %v", filename, err)
 	}
-	t, err := Parse(string(b))
-	if err != nil {
-		return nil, err
-	}
-	t.SetName(TemplateName(filename))
-	return t, nil
+	return parseNamed(TemplateName(filename), string(b))
 }
 
 // MustParse parses a template and panics if there's an error.
@@ -117,9 +521,30 @@ func MustParse(text string) *Template {
 	return t
 }
 
-// Execute combines the template with data and writes the result to wr.
-func (tmpl *Template) Execute(wr io.Writer, data map[string]interface{}) error {
-	return executeRecurse(wr, nil, newsymtab(data), tmpl.tree)
+// Execute combines the template with data and writes the result to wr. The
+// data is a map with string keys or a struct. Struct fields are looked up by
+// their json tag, or by field name if they don't have one. Output is buffered
+// unless wr has a WriteString method, like a *bytes.Buffer or *bufio.Writer,
+// so wrap a writer such as an *os.File in a *bufio.Writer. A *bufio.Writer
+// must be flushed by the caller.
+func (tmpl *Template) Execute(wr io.Writer, data interface{}) error {
+	return tmpl.ExecuteContext(context.Background(), wr, data)
+}
+
+// ExecuteContext is like Execute but stops and returns ctx.Err() if the
+// context is canceled while looping over arrays and objects or including
+// templates.
+func (tmpl *Template) ExecuteContext(ctx context.Context, wr io.Writer, data interface{}) error {
+	st := &state{ctx: ctx, done: ctx.Done(), tmpl: tmpl, root: tmpl, opts: &tmpl.opts, count: &counters{}}
+	if err := st.canceled(); err != nil {
+		return err
+	}
+	st.setWriter(wr)
+	err := st.render(newsymtab(data), tmpl, nil)
+	if ferr := st.flush(); err == nil {
+		err = ferr
+	}
+	return err
 }
 
 // ExecuteJSON combines the template with JSON data and writes the result to wr.
@@ -128,12 +553,63 @@ func (tmpl *Template) ExecuteJSON(wr io.Writer, JSON string) error {
 	if err := json.Unmarshal([]byte(JSON), &data); err != nil {
 		return fmt.Errorf("couldn't unmarshal json: %v", err)
 	}
-	return executeRecurse(wr, nil, newsymtab(data), tmpl.tree)
+	return tmpl.ExecuteContext(context.Background(), wr, data)
+}
+
+// AutoEscape escapes the output of print tags based on where in the HTML
+// document they appear. Text, attribute values, <script>, <style> and URLs
+// are each escaped differently. Use "{{&a}}" to print trusted markup. An
+// auto-escaped template included, or a block used, in a <script>, attribute
+// or other context is escaped for that context.
+// Call after Filter because the escapers depend on the strings in the template.
+// An ErrEscape error is returned if the HTML context after a section depends
+// on which branch rendered or how many times it repeated, for example
+// "{{?a}}<script>{{/?}}". The template isn't changed if an error is returned.
+func (tmpl *Template) AutoEscape() error {
+	trees := make([][]node, 1+len(tmpl.defines))
+	for i, t := range append([]*Template{tmpl}, tmpl.defines...) {
+		trees[i] = cloneTree(t.tree)
+		if err := autoEscape(trees[i], &htmlContext{}); err != nil {
+			err.Name = t.name
+			return err
+		}
+	}
+	for i, t := range append([]*Template{tmpl}, tmpl.defines...) {
+		t.tree = trees[i]
+		t.esc = &contexts{}
+	}
+	return nil
+}
+
+// Funcs adds the formatters to the template. It panics if a value in the map
+// isn't a function that can be used as a formatter.
+func (tmpl *Template) Funcs(funcs FuncMap) {
+	checkFuncs(funcs)
+	if tmpl.funcs == nil {
+		tmpl.funcs = make(FuncMap)
+	}
+	for name, fn := range funcs {
+		tmpl.funcs[name] = fn
+	}
+	for _, t := range tmpl.defines {
+		t.Funcs(funcs)
+	}
 }
 
 // Filter all strings in the template.
 func (tmpl *Template) Filter(filters Filter) {
 	filter(tmpl.tree, filters)
+	for _, t := range tmpl.defines {
+		t.Filter(filters)
+	}
+}
+
+// SetOptions sets the options used when the template is executed.
+func (tmpl *Template) SetOptions(opts ExecuteOptions) {
+	tmpl.opts = opts
+	for _, t := range tmpl.defines {
+		t.SetOptions(opts)
+	}
 }
 
 // SetName that template can be included by in a Set.
@@ -5,7 +5,12 @@ package stem
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"testing"
+	"time"
 )
 
 // ttest contains tests for go data.
@@ -15,6 +20,18 @@ var ttest = []struct {
 	data map[string]interface{} // data combined with template.
 	want string                 // want is the output we want.
 }{
+	{
+		name: "if",
+		tmpl: "{{?a}}0{{/a}}{{?b}}1{{:else}}2{{/b}}{{#c}}{{?}}{{*}}{{/}}{{/c}}",
+		data: map[string]interface{}{"a": true, "b": false, "c": []interface{}{0, 3}},
+		want:  "023",
+	},
+	{
+		name: "if expression",
+		tmpl: `{{?status == "active" && count > 0}}0{{:else}}1{{/?}}{{?!(count > 0)}}2{{/?}}`,
+		data: map[string]interface{}{"status": "active", "count": 1},
+		want:  "0",
+	},
 	{
 		name: "ifdef",
 		tmpl: "0{{+a}}1{{/a}}2",
@@ -27,6 +44,36 @@ var ttest = []struct {
 		data: map[string]interface{}{"a": ""},
 		want:  "02",
 	},
+	{
+		name: "ifdef else",
+		tmpl: "{{+a}}0{{:else}}1{{/a}}{{+b}}2{{:else}}3{{/b}}",
+		data: map[string]interface{}{"a": ""},
+		want:  "03",
+	},
+	{
+		name: "ifndef else",
+		tmpl: "{{-a}}0{{:else}}1{{/a}}{{-b}}2{{:else}}3{{/b}}",
+		data: map[string]interface{}{"a": ""},
+		want:  "12",
+	},
+	{
+		name: "object else",
+		tmpl: "{{$a}}{{*c}}{{:else}}1{{/a}}{{$b}}2{{:else}}3{{/b}}",
+		data: map[string]interface{}{
+			"a": map[string]interface{}{"c": "0"},
+			"b": "",
+		},
+		want:  "03",
+	},
+	{
+		name: "array else",
+		tmpl: "{{#a}}{{*}}{{:else}}1{{/a}}{{#b}}2{{:else}}3{{/b}}{{#c}}4{{:else}}5{{/c}}",
+		data: map[string]interface{}{
+			"a": []interface{}{0},
+			"b": []interface{}{},
+		},
+		want:  "035",
+	},
 	{
 		name: "print",
 		tmpl: "{{*a}}",
@@ -60,6 +107,44 @@ var ttest = []struct {
 		},
 		want: "01",
 	},
+	{
+		name: "path",
+		tmpl: "{{+a.b}}{{*a.b}}{{/a.b}}{{-a.c}}1{{/a.c}}{{$a.d}}{{*e}}{{/a.d}}{{#a.f}}{{*}}{{/a.f}}",
+		data: map[string]interface{}{
+			"a": map[string]interface{}{
+				"b": "0",
+				"d": map[string]interface{}{"e": "2"},
+				"f": []interface{}{3},
+			},
+		},
+		want: "0123",
+	},
+	{
+		name: "array loop",
+		tmpl: "{{*@index}}{{#a}}{{*@index}}{{*@index1}}/{{*@length}}{{?@first}}f{{/?}}{{?@last}}l{{/?}}" +
+			"{{$b}}{{*@index}}{{/b}}{{#c}}{{*@index}}{{/c}}{{*@index}},{{/a}}",
+		data: map[string]interface{}{
+			"@index": "x",
+			"a": []interface{}{
+				map[string]interface{}{"b": map[string]interface{}{}, "c": []interface{}{0, 1}},
+				map[string]interface{}{},
+			},
+		},
+		want: "01/2f0010,12/2l1,",
+	},
+	{
+		name: "each",
+		tmpl: "{{@a}}{{*@key}}={{*}}{{*c}}{{?!@last}},{{/?}}{{/a}}{{@b}}0{{:else}}1{{/b}}",
+		data: map[string]interface{}{
+			"a": map[string]interface{}{
+				"us": 3,
+				"de": 5,
+				"fr": map[string]interface{}{"c": 7},
+			},
+			"b": map[string]interface{}{},
+		},
+		want: "de=5,fr=7,us=31",
+	},
 	{
 		name: "array",
 		tmpl: "{{#a}}{{*}}{{/a}}",
@@ -153,6 +238,89 @@ func TestTemplateJSON(t *testing.T) {
 	}
 }
 
+func TestTemplateStruct(t *testing.T) {
+	type Addr struct {
+		City string `json:"city"`
+	}
+	type Base struct {
+		ID int `json:"id"`
+	}
+	type User struct {
+		Base
+		Name    string            `json:"name"`
+		Secret  string            `json:"-"`
+		Addr    *Addr             `json:"addr"`
+		Tags    []string          `json:"tags"`
+		Friends [2]Addr           `json:"friends"`
+		Extra   map[string]string `json:"extra"`
+		Title   string
+	}
+	type Root struct {
+		User User   `json:"user"`
+		Site string `json:"site"`
+	}
+	data := Root{
+		User: User{
+			Base:    Base{ID: 7},
+			Name:    "foo",
+			Secret:  "s",
+			Addr:    &Addr{City: "bar"},
+			Tags:    []string{"a", "b"},
+			Friends: [2]Addr{{City: "x"}, {City: "y"}},
+			Extra:   map[string]string{"k": "v"},
+			Title:   "t",
+		},
+		Site: "baz",
+	}
+	tmpl, err := Parse("{{$user}}{{*id}}{{*name}}{{*Secret}}{{$addr}}{{*city}}{{*site}}{{/addr}}" +
+		"{{#tags}}{{*}}{{/tags}}{{#friends}}{{*city}}{{/friends}}{{$extra}}{{*k}}{{/extra}}{{*Title}}{{/user}}")
+	if err != nil {
+		t.Fatalf("couldn't parse template: %v", err)
+	}
+	for _, d := range []interface{}{data, &data} {
+		got := bytes.NewBuffer(nil)
+		if err := tmpl.Execute(got, d); err != nil {
+			t.Fatalf("couldn't execute template: %v", err)
+		}
+		if got, want := got.String(), "7foobarbazabxyvt"; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestTemplateStructElem(t *testing.T) {
+	type Point struct {
+		X int `json:"x"`
+	}
+	day := time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC)
+	data := struct {
+		Days   []time.Time      `json:"days"`
+		Points []Point          `json:"points"`
+		ByName map[string]Point `json:"by_name"`
+		When   time.Time        `json:"when"`
+	}{
+		Days:   []time.Time{day, day.AddDate(1, 0, 0)},
+		Points: []Point{{1}, {2}},
+		ByName: map[string]Point{"a": {3}},
+		When:   day,
+	}
+	set := NewSet()
+	if err := addTemplate(t, set, "year", `{{*|date "2006"}}`); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	if err := addTemplate(t, set, "page", `{{#days}}[{{*|date "2006-01-02"}}]{{/days}}{{#points}}{{*x}}{{/points}}`+
+		`{{@by_name}}{{*@key}}={{*x}}{{/by_name}}{{#days}}[{{+}}{{>year}}{{/}}]{{/days}}{{>year when}}`); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	got := bytes.NewBuffer(nil)
+	if err := set.Execute(got, "page", data); err != nil {
+		t.Fatalf("couldn't execute template: %v", err)
+	}
+	if got, want := got.String(), "[2015-01-02][2016-01-02]12a=3[2015][2016]2015"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
 func TestTemplateInclude(t *testing.T) {
 	set := NewSet()
 
@@ -181,3 +349,202 @@ func TestTemplateInclude(t *testing.T) {
 		t.Fatalf("got %v, want %v", got, want)
 	}
 }
+
+func TestMissingKey(t *testing.T) {
+	tests := []struct {
+		name string     // name of test printed with errors.
+		mk   MissingKey // mk is the MissingKey option.
+		tmpl string     // tmpl is the template.
+		want string     // want this output, or error if empty.
+	}{
+		{"zero print", MissingZero, "0{{*b}}1", "01"},
+		{"keep print", MissingKeep, "0{{*b}}{{*a}}1", "0{{*b}}x1"},
+		{"keep source", MissingKeep, "0{{* b }}{{* b|upper }}1", "0{{* b }}{{* b|upper }}1"},
+		{"keep include", MissingKeep, "0{{>b}}1", "0{{>b}}1"},
+		{"keep section", MissingKeep, "0{{#b}}x{{/b}}1", "01"},
+		{"error print", MissingError, "{{*a}}\n{{*b}}", ""},
+		{"error include", MissingError, "{{>b}}", ""},
+		{"error array", MissingError, "{{#b}}{{/b}}", ""},
+		{"error object", MissingError, "{{$b}}{{/b}}", ""},
+		{"error each", MissingError, "{{@b}}{{/b}}", ""},
+		{"error default", MissingError, `{{*b|default "y"}}`, "y"},
+		{"error else", MissingError, "{{#b}}{{:else}}0{{/b}}", "0"},
+		{"error ifdef", MissingError, "{{+b}}0{{/b}}{{-b}}1{{/b}}{{?b}}2{{/?}}", "1"},
+		{"error null", MissingError, "{{*c}}{{#c}}{{/c}}0", "0"},
+	}
+	for _, test := range tests {
+		tmpl := MustParse(test.tmpl)
+		tmpl.SetOptions(ExecuteOptions{MissingKey: test.mk})
+		got := bytes.NewBuffer(nil)
+		err := tmpl.ExecuteJSON(got, `{"a": "x", "c": null}`)
+		if test.want == "" {
+			var e *Error
+			if !errors.As(err, &e) || e.Kind != ErrMissing {
+				t.Fatalf("test %q, got error %v, want missing", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %q, couldn't execute template: %v", test.name, err)
+		}
+		if got.String() != test.want {
+			t.Fatalf("test %q, got %q, want %q", test.name, got.String(), test.want)
+		}
+	}
+}
+
+func TestMissingKeyError(t *testing.T) {
+	set := NewSet()
+	tmpl := MustParse("a\n{{*usernmae}}")
+	tmpl.SetName("page")
+	set.Add(tmpl)
+	set.SetOptions(ExecuteOptions{MissingKey: MissingError})
+	err := set.Execute(bytes.NewBuffer(nil), "page", map[string]interface{}{"username": "x"})
+	if got, want := fmt.Sprint(err), `page:2:1: "usernmae" not defined: {{*usernmae}}`; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestTemplateDefine(t *testing.T) {
+	tmpl := MustParse("{{%define tree}}{{*name}}{{#children}}{{?@first}}({{/?}}{{>tree}}{{?@last}}){{/?}}{{/children}}{{/tree}}{{>tree}}")
+	got := bytes.NewBuffer(nil)
+	data := `{"name": "a", "children": [{"name": "b", "children": []}, {"name": "c", "children": [{"name": "d", "children": []}]}]}`
+	if err := tmpl.ExecuteJSON(got, data); err != nil {
+		t.Fatalf("couldn't execute: %v", err)
+	}
+	if got, want := got.String(), "a(bc(d))"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Defined templates are added to the set with the outer template.
+	set := NewSet()
+	tmpl.SetName("page")
+	if err := set.Add(tmpl); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	if err := addTemplate(t, set, "other", "{{>tree}}"); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	got.Reset()
+	if err := set.ExecuteJSON(got, "other", `{"name": "x", "children": []}`); err != nil {
+		t.Fatalf("couldn't execute: %v", err)
+	}
+	if got, want := got.String(), "x"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// A cycle between defined templates adds none of them.
+	err := addTemplate(t, set, "cycle", "{{%define x}}{{>y}}{{/x}}{{%define y}}{{>x}}{{/y}}")
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != ErrCycle {
+		t.Fatalf("got error %v, want cycle", err)
+	}
+	if set.template("cycle") != nil || set.template("x") != nil || set.template("y") != nil {
+		t.Fatal("template with cycle added")
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tmpl := MustParse("{{#a}}{{*|cancel}}{{/a}}")
+	tmpl.Funcs(FuncMap{"cancel": func(v float64) float64 {
+		if v == 2 {
+			cancel()
+		}
+		return v
+	}})
+	got := bytes.NewBuffer(nil)
+	err := tmpl.ExecuteContext(ctx, got, map[string]interface{}{"a": []float64{1, 2, 3, 4}})
+	if err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if got, want := got.String(), "12"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	set := NewSet()
+	if err := addTemplate(t, set, "a", "{{>b}}"); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	if err := addTemplate(t, set, "b", "b"); err != nil {
+		t.Fatalf("couldn't add template: %v", err)
+	}
+	got.Reset()
+	if err := set.ExecuteContext(ctx, got, "a", nil); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if got.Len() != 0 {
+		t.Fatalf("got %q, want no output", got.String())
+	}
+}
+
+// writeCounter counts calls to Write. It doesn't have a WriteString method,
+// like a net.Conn.
+type writeCounter struct {
+	writes int
+}
+
+func (w *writeCounter) Write(b []byte) (int, error) {
+	w.writes++
+	return len(b), nil
+}
+
+// benchData returns rows of strings and numbers.
+func benchData() map[string]interface{} {
+	rows := make([]interface{}, 1000)
+	for i := range rows {
+		rows[i] = map[string]interface{}{"name": "row", "n": float64(i), "ok": i%2 == 0}
+	}
+	return map[string]interface{}{"rows": rows}
+}
+
+func benchmarkExecute(b *testing.B, wr io.Writer) {
+	tmpl := MustParse("<table>{{#rows}}<tr><td>{{*name}}</td><td>{{*n}}</td><td>{{*ok}}</td></tr>{{/rows}}</table>")
+	data := benchData()
+	b.ReportAllocs()
+	b.ResetTimer()
+	buf, _ := wr.(*bytes.Buffer)
+	for i := 0; i < b.N; i++ {
+		if buf != nil {
+			buf.Reset()
+		}
+		if err := tmpl.Execute(wr, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExecute(b *testing.B) {
+	wr := &writeCounter{}
+	benchmarkExecute(b, wr)
+	b.ReportMetric(float64(wr.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkExecuteStringWriter(b *testing.B) {
+	benchmarkExecute(b, &bytes.Buffer{})
+}
+
+func TestExecuteBuffered(t *testing.T) {
+	tmpl := MustParse("{{#a}}{{*}},{{/a}}{{*b|fail}}")
+	tmpl.Funcs(FuncMap{"fail": func(v interface{}) (interface{}, error) {
+		return nil, errors.New("fail")
+	}})
+	got := bytes.NewBuffer(nil)
+	// The output before the error is flushed.
+	err := tmpl.Execute(writeOnly{got}, map[string]interface{}{"a": []interface{}{1, "x", true}})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if got, want := got.String(), "1,x,true,"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// writeOnly hides the WriteString method of the writer.
+type writeOnly struct {
+	w io.Writer
+}
+
+func (w writeOnly) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
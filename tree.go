@@ -4,12 +4,22 @@
 package stem
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 )
 
 // depthLimit is the max recurse depth used to stop pathological cases.
 const depthLimit = 32
 
+// pos is the location of a tag in the template source.
+type pos struct {
+	line int    // line starting at 1.
+	col  int    // col is the byte offset in the line starting at 1.
+	tag  string // tag is the source of the tag.
+}
+
 // node in the parse tree.
 type node interface {
 	// Prints node type.
@@ -18,36 +28,98 @@ type node interface {
 
 // nodeArray is a repeated section.
 type nodeArray struct {
+	pos   pos
+	name  string
+	nodes []node
+	alt   []node // alt renders if the array is empty or not defined.
+}
+
+// nodeBlock is a named section a template that extends this one can replace.
+type nodeBlock struct {
+	pos   pos
+	name  string
+	nodes []node       // nodes are the default content.
+	ctx   *htmlContext // ctx is where the block is, nil unless auto-escaped.
+}
+
+// nodeDefine is a template defined inside of another template. It is removed
+// from the tree when the template is parsed.
+type nodeDefine struct {
+	pos   pos
 	name  string
 	nodes []node
 }
 
+// nodeEach is repeated for every entry of an object.
+type nodeEach struct {
+	pos   pos
+	name  string
+	nodes []node
+	alt   []node // alt renders if the object is empty or not defined.
+}
+
+// nodeExtends renders the parent template with the blocks of this template.
+type nodeExtends struct {
+	pos  pos
+	name string
+}
+
+// nodeIf renders if the expression is true.
+type nodeIf struct {
+	pos   pos
+	name  string // name is the expression source, used to match the end tag.
+	expr  expr
+	nodes []node
+	alt   []node // alt renders if the expression is false.
+}
+
 // nodeIfdef renders if the name is defined.
 type nodeIfdef struct {
+	pos   pos
 	name  string
 	nodes []node
+	alt   []node // alt renders if the name is not defined.
 }
 
 // nodeIfndef renders if the name is not defined.
 type nodeIfndef struct {
+	pos   pos
 	name  string
 	nodes []node
+	alt   []node // alt renders if the name is defined.
 }
 
 // nodeInclude includes another template by name.
 type nodeInclude struct {
+	pos   pos
+	val   string // val is the value of the tag.
+	name  string
+	scope expr         // scope is the innermost scope of the template, may be nil.
+	args  []*arg       // args are added as an object scope after the scope.
+	ctx   *htmlContext // ctx is where the include is, nil unless auto-escaped.
+}
+
+// arg is a named argument of an include.
+type arg struct {
 	name string
+	val  expr
 }
 
 // nodeObject enters a JSON object.
 type nodeObject struct {
+	pos   pos
 	name  string
 	nodes []node
+	alt   []node // alt renders if the object is not defined.
 }
 
 // nodePrint prints a symbol.
 type nodePrint struct {
+	pos  pos
 	name string
+	pipe []*call   // pipe are the formatters applied to the symbol in order.
+	raw  bool      // raw is true if the symbol is never escaped.
+	esc  []escaper // esc is applied to the output in order.
 }
 
 // nodeString is a string literal.
@@ -59,6 +131,26 @@ func (n *nodeArray) String() string {
 	return "array"
 }
 
+func (n *nodeBlock) String() string {
+	return "block"
+}
+
+func (n *nodeDefine) String() string {
+	return "define"
+}
+
+func (n *nodeEach) String() string {
+	return "each"
+}
+
+func (n *nodeExtends) String() string {
+	return "extends"
+}
+
+func (n *nodeIf) String() string {
+	return "if"
+}
+
 func (n *nodeIfdef) String() string {
 	return "ifdef"
 }
@@ -79,73 +171,408 @@ func (n *nodePrint) String() string {
 	return "print"
 }
 
+// hasDefault returns true if the pipeline has a default formatter, which means
+// the symbol isn't required to be defined.
+func (n *nodePrint) hasDefault() bool {
+	for _, c := range n.pipe {
+		if c.name == "default" {
+			return true
+		}
+	}
+	return false
+}
+
 func (n *nodeString) String() string {
 	return "string"
 }
 
 // parse creates a parse tree.
 func parse(name, src string) ([]node, error) {
-	return parseRecurse(make([]node, 0), newLexer(name, src), nil, 0)
+	tree, _, err := parseRecurse(make([]node, 0), newLexer(name, src), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if errs := checkBlocks(name, tree); errs != nil {
+		return nil, errs[0]
+	}
+	return tree, nil
+}
+
+// parseAll creates a parse tree and returns every error instead of stopping
+// at the first one. The tree leaves out the tags that couldn't be parsed. The
+// tree is nil if an error stopped parsing, which only happens for ErrDepth.
+func parseAll(name, src string) ([]node, []error) {
+	l := newLexer(name, src)
+	l.all = true
+	tree, _, err := parseRecurse(make([]node, 0), l, nil, 0)
+	errs := l.errs
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	return tree, append(errs, checkBlocks(name, tree)...)
+}
+
+// checkBlocks returns an error for every block name used twice, template
+// defined twice or extends after the first. The blocks of a defined template
+// are checked separately.
+func checkBlocks(name string, tree []node) []error {
+	var errs []error
+	seen := make(map[string]bool)
+	defined := make(map[string]bool)
+	var ext *nodeExtends
+	inspect(tree, func(n node) {
+		var p pos
+		var msg string
+		switch nt := n.(type) {
+		case *nodeBlock:
+			if !seen[nt.name] {
+				seen[nt.name] = true
+				return
+			}
+			p, msg = nt.pos, "duplicate block"
+		case *nodeDefine:
+			if defined[nt.name] || nt.name == name {
+				p, msg = nt.pos, "duplicate define"
+				break
+			}
+			defined[nt.name] = true
+			errs = append(errs, checkBlocks(name, nt.nodes)...)
+			return
+		case *nodeExtends:
+			if ext == nil {
+				ext = nt
+				return
+			}
+			p, msg = nt.pos, "duplicate extends"
+		default:
+			return
+		}
+		errs = append(errs, &Error{Kind: ErrSyntax, Name: name, Line: p.line, Col: p.col, Tag: p.tag, Err: errors.New(msg)})
+	})
+	return errs
+}
+
+// inspect calls fn for every node in the tree in order, including the nodes of
+// sections.
+func inspect(tree []node, fn func(n node)) {
+	for _, n := range tree {
+		fn(n)
+		switch nt := n.(type) {
+		case *nodeArray:
+			inspect(nt.nodes, fn)
+			inspect(nt.alt, fn)
+		case *nodeBlock:
+			inspect(nt.nodes, fn)
+		case *nodeEach:
+			inspect(nt.nodes, fn)
+			inspect(nt.alt, fn)
+		case *nodeIf:
+			inspect(nt.nodes, fn)
+			inspect(nt.alt, fn)
+		case *nodeIfdef:
+			inspect(nt.nodes, fn)
+			inspect(nt.alt, fn)
+		case *nodeIfndef:
+			inspect(nt.nodes, fn)
+			inspect(nt.alt, fn)
+		case *nodeObject:
+			inspect(nt.nodes, fn)
+			inspect(nt.alt, fn)
+		}
+	}
+}
+
+// argName matches the start of a named include argument.
+var argName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// parseInclude parses the template name followed by an optional scope and
+// named arguments, for example "card user size=\"small\"". The scope and
+// argument values are expression operands.
+func parseInclude(val string) (*nodeInclude, error) {
+	n := &nodeInclude{val: val}
+	val = strings.TrimLeft(val, " \t\r\n")
+	i := strings.IndexAny(val, " \t\r\n")
+	if i == -1 {
+		n.name = val
+		return n, nil
+	}
+	n.name = val[:i]
+	p := &exprParser{src: val, s: val[i:]}
+	seen := make(map[string]bool)
+	for p.skip(); p.s != ""; p.skip() {
+		m := argName.FindString(p.s)
+		if m == "" || strings.HasPrefix(p.s[len(m):], "=") {
+			if n.scope != nil || n.args != nil {
+				return nil, p.error("unexpected %q", p.s)
+			}
+			e, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			n.scope = e
+			continue
+		}
+		name := m[:len(m)-1]
+		if seen[name] {
+			return nil, p.error("duplicate argument %q", name)
+		}
+		seen[name] = true
+		p.s = p.s[len(m):]
+		e, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		n.args = append(n.args, &arg{name: name, val: e})
+	}
+	return n, nil
+}
+
+// directive splits the value of a directive tag into the keyword and name.
+func directive(val string) (keyword, name string) {
+	f := strings.Fields(val)
+	if len(f) != 2 {
+		return "", ""
+	}
+	return f[0], f[1]
 }
 
-// parseRecurse recursively builds a parse tree.
-func parseRecurse(tree []node, l *lexer, end *token, depth int) ([]node, error) {
+// endName returns the name the end tag of a section must have.
+func endName(t *token) string {
+	if t.tt == ttDirective {
+		_, name := directive(t.val)
+		return name
+	}
+	return t.val
+}
+
+// parseSection parses the nodes of the section opened by t. The alt nodes are
+// the nodes after the else tag, or nil if there is no else tag.
+func parseSection(l *lexer, t *token, depth int) (nodes, alt []node, err error) {
+	nodes, elseTok, err := parseRecurse(make([]node, 0), l, t, depth)
+	if err != nil || elseTok == nil {
+		return nodes, nil, err
+	}
+	alt, elseTok, err = parseRecurse(make([]node, 0), l, t, depth)
+	if err != nil {
+		return nil, nil, err
+	}
+	for elseTok != nil {
+		if err := l.Error(elseTok, ErrSyntax, "duplicate else"); !l.report(err) {
+			return nil, nil, err
+		}
+		// Recover by adding the nodes after the else to the alt nodes.
+		var more []node
+		more, elseTok, err = parseRecurse(make([]node, 0), l, t, depth)
+		if err != nil {
+			return nil, nil, err
+		}
+		alt = append(alt, more...)
+	}
+	return nodes, alt, nil
+}
+
+// parseRecurse recursively builds a parse tree. If the tree ended with an else
+// tag instead of an end tag the else token is returned. When the lexer reports
+// errors instead of stopping, tags that can't be parsed are left out of the
+// tree.
+func parseRecurse(tree []node, l *lexer, end *token, depth int) ([]node, *token, error) {
 	depth++
 	if depth > depthLimit {
-		return nil, fmt.Errorf("depth limit %v", depthLimit)
+		return nil, nil, l.Error(end, ErrDepth, "depth limit ", depthLimit)
 	}
 	for {
 		t, err := l.Next()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if t == nil {
 			if end != nil {
-				return nil, fmt.Errorf("unclosed scope %v", end)
+				if err := l.Error(end, ErrUnclosed, "unclosed scope"); !l.report(err) {
+					return nil, nil, err
+				}
 			}
-			return tree, nil
+			return tree, nil, nil
 		}
 		switch t.tt {
-		case ttArray:
-			nodes, err := parseRecurse(make([]node, 0), l, t, depth)
-			if err != nil {
-				return nil, err
+		case ttElse:
+			if t.val != "else" {
+				if err := l.Error(t, ErrSyntax, "unrecognized tag"); !l.report(err) {
+					return nil, nil, err
+				}
+				continue
+			}
+			if end == nil {
+				if err := l.Error(t, ErrSyntax, "else outside of scope"); !l.report(err) {
+					return nil, nil, err
+				}
+				continue
 			}
-			tree = append(tree, &nodeArray{name: t.val, nodes: nodes})
+			return tree, t, nil
 		case ttEnd:
 			if end == nil {
-				return nil, fmt.Errorf("unopened scope %v", t)
+				if err := l.Error(t, ErrUnopened, "unopened scope"); !l.report(err) {
+					return nil, nil, err
+				}
+				continue
 			}
-			if t.val != end.val {
-				return nil, fmt.Errorf("unmatched tag %v", t)
+			// "{{/?}}" closes any condition.
+			if t.val != endName(end) && !(end.tt == ttIf && t.val == "?") {
+				// Recover by closing the scope.
+				if err := l.Error(t, ErrUnmatched, "unmatched tag, expecting end of ", l.tag(end)); !l.report(err) {
+					return nil, nil, err
+				}
 			}
-			return tree, nil
-		case ttIfdef:
-			nodes, err := parseRecurse(make([]node, 0), l, t, depth)
-			if err != nil {
-				return nil, err
+			return tree, nil, nil
+		case ttString:
+			tree = append(tree, &nodeString{val: t.val})
+			continue
+		}
+		n, err := newNode(t.tt, t.val, pos{line: t.line, col: t.col, tag: l.tag(t)})
+		if err != nil {
+			if err := l.Error(t, ErrSyntax, err); !l.report(err) {
+				return nil, nil, err
 			}
-			tree = append(tree, &nodeIfdef{name: t.val, nodes: nodes})
-		case ttIfndef:
-			nodes, err := parseRecurse(make([]node, 0), l, t, depth)
-			if err != nil {
-				return nil, err
+			if err := skipSection(l, t, depth); err != nil {
+				return nil, nil, err
 			}
-			tree = append(tree, &nodeIfndef{name: t.val, nodes: nodes})
-		case ttInclude:
-			tree = append(tree, &nodeInclude{name: t.val})
-		case ttObject:
-			nodes, err := parseRecurse(make([]node, 0), l, t, depth)
-			if err != nil {
+			continue
+		}
+		switch nt := n.(type) {
+		case *nodeArray:
+			nt.nodes, nt.alt, err = parseSection(l, t, depth)
+		case *nodeBlock:
+			nt.nodes, err = parseBody(l, t, depth, "else in block")
+		case *nodeDefine:
+			if end != nil {
+				if err := l.Error(t, ErrSyntax, "define inside of scope"); !l.report(err) {
+					return nil, nil, err
+				}
+				if err := skipSection(l, t, depth); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			nt.nodes, err = parseBody(l, t, depth, "else in define")
+		case *nodeEach:
+			nt.nodes, nt.alt, err = parseSection(l, t, depth)
+		case *nodeExtends:
+			if end != nil {
+				if err := l.Error(t, ErrSyntax, "extends inside of scope"); !l.report(err) {
+					return nil, nil, err
+				}
+				continue
+			}
+		case *nodeIf:
+			nt.nodes, nt.alt, err = parseSection(l, t, depth)
+		case *nodeIfdef:
+			nt.nodes, nt.alt, err = parseSection(l, t, depth)
+		case *nodeIfndef:
+			nt.nodes, nt.alt, err = parseSection(l, t, depth)
+		case *nodeObject:
+			nt.nodes, nt.alt, err = parseSection(l, t, depth)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		tree = append(tree, n)
+	}
+}
+
+// skipSection parses and drops the nodes of a tag that couldn't be parsed, if
+// the tag opens a section, so its end tag doesn't cause another error.
+func skipSection(l *lexer, t *token, depth int) error {
+	switch t.tt {
+	case ttArray, ttEach, ttIf, ttIfdef, ttIfndef, ttObject:
+	case ttDirective:
+		if keyword, _ := directive(t.val); keyword != "block" && keyword != "define" {
+			return nil
+		}
+	default:
+		return nil
+	}
+	_, _, err := parseSection(l, t, depth)
+	return err
+}
+
+// parseBody parses the nodes of a block or define, which can't have an else.
+func parseBody(l *lexer, t *token, depth int, elseMsg string) ([]node, error) {
+	nodes, elseTok, err := parseRecurse(make([]node, 0), l, t, depth)
+	if err != nil {
+		return nil, err
+	}
+	for elseTok != nil {
+		if err := l.Error(elseTok, ErrSyntax, elseMsg); !l.report(err) {
+			return nil, err
+		}
+		// Recover by adding the nodes after the else.
+		var more []node
+		more, elseTok, err = parseRecurse(make([]node, 0), l, t, depth)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, more...)
+	}
+	return nodes, nil
+}
+
+// newNode returns the node for a tag. The nodes of sections are not set.
+func newNode(tt ttype, val string, p pos) (node, error) {
+	switch tt {
+	case ttArray, ttEach, ttIfdef, ttIfndef, ttObject:
+		if _, err := parsePath(val); err != nil {
+			return nil, err
+		}
+	}
+	switch tt {
+	case ttArray:
+		return &nodeArray{pos: p, name: val}, nil
+	case ttDirective:
+		keyword, name := directive(val)
+		switch keyword {
+		case "block":
+			if _, err := parsePath(name); err != nil {
 				return nil, err
 			}
-			tree = append(tree, &nodeObject{name: t.val, nodes: nodes})
-		case ttPrint:
-			tree = append(tree, &nodePrint{name: t.val})
-		case ttString:
-			tree = append(tree, &nodeString{val: t.val})
-		default:
-			panic(fmt.Sprintf("unknown type %q, programmer error", t.tt))
+			return &nodeBlock{pos: p, name: name}, nil
+		case "define":
+			if name == "" {
+				return nil, errors.New("malformed tag")
+			}
+			return &nodeDefine{pos: p, name: name}, nil
+		case "extends":
+			return &nodeExtends{pos: p, name: name}, nil
+		}
+		return nil, errors.New("unrecognized tag")
+	case ttEach:
+		return &nodeEach{pos: p, name: val}, nil
+	case ttIf:
+		e, err := parseExpr(val)
+		if err != nil {
+			return nil, err
+		}
+		return &nodeIf{pos: p, name: val, expr: e}, nil
+	case ttIfdef:
+		return &nodeIfdef{pos: p, name: val}, nil
+	case ttIfndef:
+		return &nodeIfndef{pos: p, name: val}, nil
+	case ttInclude:
+		n, err := parseInclude(val)
+		if err != nil {
+			return nil, err
+		}
+		n.pos = p
+		return n, nil
+	case ttObject:
+		return &nodeObject{pos: p, name: val}, nil
+	case ttPrint, ttRaw:
+		name, pipe, err := parsePipeline(val)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parsePath(name); err != nil {
+			return nil, err
 		}
+		return &nodePrint{pos: p, name: name, pipe: pipe, raw: tt == ttRaw}, nil
 	}
+	panic(fmt.Sprintf("unknown type %q, programmer error", tt))
 }
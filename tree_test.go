@@ -19,9 +19,11 @@ func TestTree(t *testing.T) {
 			src:  "{{#a}}{{*b}}{{/a}}",
 			want: []node{
 				&nodeArray{
+					pos:   pos{line: 1, col: 1, tag: "{{#a}}"},
 					name:  "a",
 					nodes: []node{
 						&nodePrint{
+							pos:  pos{line: 1, col: 7, tag: "{{*b}}"},
 							name: "b",
 						},
 					},
@@ -33,14 +35,49 @@ func TestTree(t *testing.T) {
 			src:  "{{!a}}",
 			want: []node{},
 		},
+		{
+			name: "each",
+			src:  "{{@a}}{{*@key}}{{/a}}",
+			want: []node{
+				&nodeEach{
+					pos:   pos{line: 1, col: 1, tag: "{{@a}}"},
+					name:  "a",
+					nodes: []node{
+						&nodePrint{
+							pos:  pos{line: 1, col: 7, tag: "{{*@key}}"},
+							name: "@key",
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "if",
+			src:  "{{?a}}{{*b}}{{/a}}",
+			want: []node{
+				&nodeIf{
+					pos:   pos{line: 1, col: 1, tag: "{{?a}}"},
+					name:  "a",
+					expr:  &exprPath{name: "a"},
+					nodes: []node{
+						&nodePrint{
+							pos:  pos{line: 1, col: 7, tag: "{{*b}}"},
+							name: "b",
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "ifdef",
 			src:  "{{+a}}{{*b}}{{/a}}",
 			want: []node{
 				&nodeIfdef{
+					pos:   pos{line: 1, col: 1, tag: "{{+a}}"},
 					name:  "a",
 					nodes: []node{
 						&nodePrint{
+							pos:  pos{line: 1, col: 7, tag: "{{*b}}"},
 							name: "b",
 						},
 					},
@@ -52,20 +89,46 @@ func TestTree(t *testing.T) {
 			src:  "{{-a}}{{*b}}{{/a}}",
 			want: []node{
 				&nodeIfndef{
+					pos:   pos{line: 1, col: 1, tag: "{{-a}}"},
 					name:  "a",
 					nodes: []node{
 						&nodePrint{
+							pos:  pos{line: 1, col: 7, tag: "{{*b}}"},
 							name: "b",
 						},
 					},
 				},
 			},
 		},
+		{
+			name: "else",
+			src:  "{{+a}}{{*b}}{{:else}}{{*c}}{{/a}}",
+			want: []node{
+				&nodeIfdef{
+					pos:   pos{line: 1, col: 1, tag: "{{+a}}"},
+					name:  "a",
+					nodes: []node{
+						&nodePrint{
+							pos:  pos{line: 1, col: 7, tag: "{{*b}}"},
+							name: "b",
+						},
+					},
+					alt: []node{
+						&nodePrint{
+							pos:  pos{line: 1, col: 22, tag: "{{*c}}"},
+							name: "c",
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "include",
 			src:  "{{>a}}",
 			want: []node{
 				&nodeInclude{
+					pos:  pos{line: 1, col: 1, tag: "{{>a}}"},
+					val:  "a",
 					name: "a",
 				},
 			},
@@ -75,15 +138,63 @@ func TestTree(t *testing.T) {
 			src:  "{{$a}}{{*b}}{{/a}}",
 			want: []node{
 				&nodeObject{
+					pos:   pos{line: 1, col: 1, tag: "{{$a}}"},
 					name:  "a",
 					nodes: []node{
 						&nodePrint{
+							pos:  pos{line: 1, col: 7, tag: "{{*b}}"},
 							name: "b",
 						},
 					},
 				},
 			},
 		},
+		{
+			name: "raw",
+			src:  "{{&a}}",
+			want: []node{
+				&nodePrint{
+					pos:  pos{line: 1, col: 1, tag: "{{&a}}"},
+					name: "a",
+					raw:  true,
+				},
+			},
+		},
+		{
+			name: "include arguments",
+			src:  "{{>card user.a size=\"small\" n=1}}",
+			want: []node{
+				&nodeInclude{
+					pos:   pos{line: 1, col: 1, tag: "{{>card user.a size=\"small\" n=1}}"},
+					val:   "card user.a size=\"small\" n=1",
+					name:  "card",
+					scope: &exprPath{name: "user.a"},
+					args: []*arg{
+						{name: "size", val: &exprLit{val: "small"}},
+						{name: "n", val: &exprLit{val: 1.0}},
+					},
+				},
+			},
+		},
+		{
+			name: "extends",
+			src:  "{{%extends a}}{{%block b}}c{{/b}}",
+			want: []node{
+				&nodeExtends{
+					pos:  pos{line: 1, col: 1, tag: "{{%extends a}}"},
+					name: "a",
+				},
+				&nodeBlock{
+					pos:  pos{line: 1, col: 15, tag: "{{%block b}}"},
+					name: "b",
+					nodes: []node{
+						&nodeString{
+							val: "c",
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "string",
 			src:  "abc",
@@ -98,12 +209,15 @@ func TestTree(t *testing.T) {
 			src:  "{{#a}}{{#a}}{{*b}}{{/a}}{{/a}}",
 			want: []node{
 				&nodeArray{
+					pos:   pos{line: 1, col: 1, tag: "{{#a}}"},
 					name:  "a",
 					nodes: []node{
 						&nodeArray{
+							pos:  pos{line: 1, col: 7, tag: "{{#a}}"},
 							name: "a",
 							nodes: []node{
 								&nodePrint{
+									pos:  pos{line: 1, col: 13, tag: "{{*b}}"},
 									name: "b",
 								},	
 							},
@@ -124,3 +238,36 @@ func TestTree(t *testing.T) {
 		}
 	}
 }
+
+func TestTreeError(t *testing.T) {
+	tests := []struct {
+		name string // name of test printed with errors.
+		src  string // src is the template.
+	}{
+		{"unclosed", "{{#a}}"},
+		{"unopened", "{{/a}}"},
+		{"unmatched", "{{#a}}{{/b}}"},
+		{"else outside scope", "{{:else}}"},
+		{"duplicate else", "{{+a}}{{:else}}{{:else}}{{/a}}"},
+		{"unrecognized else", "{{+a}}{{:elsif}}{{/a}}"},
+		{"unrecognized directive", "{{%a b}}"},
+		{"define inside scope", "{{#a}}{{%define b}}{{/b}}{{/a}}"},
+		{"duplicate define", "{{%define a}}{{/a}}{{%define a}}{{/a}}"},
+		{"else in define", "{{%define a}}{{:else}}{{/a}}"},
+		{"include two scopes", "{{>a b c}}"},
+		{"include scope after argument", "{{>a b=1 c}}"},
+		{"include duplicate argument", "{{>a b=1 b=2}}"},
+		{"include missing argument", "{{>a b=}}"},
+		{"malformed block", "{{%block}}{{/block}}"},
+		{"unmatched block", "{{%block a}}{{/block}}"},
+		{"else in block", "{{%block a}}{{:else}}{{/a}}"},
+		{"duplicate block", "{{%block a}}{{/a}}{{#b}}{{%block a}}{{/a}}{{/b}}"},
+		{"duplicate extends", "{{%extends a}}{{%extends b}}"},
+		{"extends inside scope", "{{#a}}{{%extends b}}{{/a}}"},
+	}
+	for _, test := range tests {
+		if _, err := parse(test.name, test.src); err == nil {
+			t.Fatalf("test %q, expected error", test.name)
+		}
+	}
+}
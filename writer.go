@@ -0,0 +1,45 @@
+// Copyright 2015 Seth Bunce. All rights reserved. Use of this source code is
+// governed by a BSD-style license that can be found in the LICENSE file.
+
+package stem
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// bufSize is the size of the buffer used for writers that don't buffer.
+const bufSize = 4096
+
+// bufPool reuses buffers between executions.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriterSize(nil, bufSize)
+	},
+}
+
+// setWriter sets the writer strings are written to. A writer with a
+// WriteString method is written to directly, other writers are wrapped in a
+// buffer which must be flushed.
+func (st *state) setWriter(wr io.Writer) {
+	if w, ok := wr.(io.StringWriter); ok {
+		st.wr = w
+		return
+	}
+	st.buf = bufPool.Get().(*bufio.Writer)
+	st.buf.Reset(wr)
+	st.wr = st.buf
+}
+
+// flush writes the buffered output and returns the buffer to the pool.
+func (st *state) flush() error {
+	if st.buf == nil {
+		return nil
+	}
+	err := st.buf.Flush()
+	st.buf.Reset(nil)
+	bufPool.Put(st.buf)
+	st.buf = nil
+	return err
+}